@@ -74,13 +74,16 @@ func (e ShapeSvgStringTooLongError) Error() string {
 // - ShapeOwnerError
 // - OutofBoundError: if any point is outside canvas size, return error
 // - InsufficientInkError: if given minerInk is less then ink needed
-// - InvalidShapeSvgStringError: if given filled type with not closed shape
-func AddShapeToMap(svgString string, publicKey string, shapeType string, minerInk int, mapPoints map[string]MapPoint) (ink int, err error) {
+// - InvalidShapeSvgStringError: if given filled type with not closed shape,
+//   or a string the parser can't read
+func AddShapeToMap(svgString string, publicKey string, shapeType string, minerInk int, mapPoints map[string]MapPoint, canvasXMax int, canvasYMax int) (ink int, err error) {
+	defer recoverInvalidSvg(svgString, &err)
+	canvasMax := point{x: canvasXMax, y: canvasYMax}
 	var transparentMapPoints map[int]point
 	var polygon [][]bool
 	var close bool
 	if shapeType == "transparent" {
-		transparentMapPoints, ink, _, err = TransparentSvgToCoord(svgString, publicKey, minerInk)
+		transparentMapPoints, ink, _, err = svgToCoord(svgString, publicKey, minerInk, canvasMax)
 		if err != nil {
 			fmt.Println(err)
 			return 0, err
@@ -101,7 +104,10 @@ func AddShapeToMap(svgString string, publicKey string, shapeType string, minerIn
 		}
 		// filled
 	} else {
-		transparentMapPoints, _, close, err = TransparentSvgToCoord(svgString, publicKey, minerInk)
+		transparentMapPoints, _, close, err = svgToCoord(svgString, publicKey, minerInk, canvasMax)
+		if _, ok := err.(OutOfBoundsError); ok {
+			return 0, err
+		}
 		if !close {
 			err = InvalidShapeSvgStringError(svgString)
 			fmt.Println(err)
@@ -144,6 +150,73 @@ func AddShapeToMap(svgString string, publicKey string, shapeType string, minerIn
 	return ink, nil
 }
 
+// Deferred by the exported functions that parse svg strings. The parser
+// indexes past the end of some malformed strings, and a caller such as the
+// miner must not crash on one, so such a panic becomes an
+// InvalidShapeSvgStringError.
+func recoverInvalidSvg(svgString string, err *error) {
+	if recover() != nil {
+		*err = InvalidShapeSvgStringError(svgString)
+	}
+}
+
+// Returns the ink needed to draw the shape on a canvas of the given size,
+// without adding it to any map.
+// Can return the following errors:
+// - OutOfBoundsError: if any point is outside the canvas
+// - InvalidShapeSvgStringError: if the svg string can't be parsed, or a
+//   filled shape is not closed
+func ShapeInk(svgString string, shapeType string, canvasXMax int, canvasYMax int) (ink int, err error) {
+	defer recoverInvalidSvg(svgString, &err)
+
+	transparentMapPoints, ink, close, err := svgToCoord(svgString, "", math.MaxInt32, point{x: canvasXMax, y: canvasYMax})
+	if err != nil || shapeType == "transparent" {
+		return ink, err
+	}
+	if !close {
+		return 0, InvalidShapeSvgStringError(svgString)
+	}
+	_, ink, err = FilledSvgToPolygon(transparentMapPoints, "", math.MaxInt32)
+	return ink, err
+}
+
+// Returns the points the shape covers on a canvas of the given size, as
+// [x, y] pairs, each once.
+// Can return the same errors as ShapeInk.
+func ShapePoints(svgString string, shapeType string, canvasXMax int, canvasYMax int) (points [][2]int, err error) {
+	defer recoverInvalidSvg(svgString, &err)
+
+	transparentMapPoints, _, close, err := svgToCoord(svgString, "", math.MaxInt32, point{x: canvasXMax, y: canvasYMax})
+	if err != nil {
+		return nil, err
+	}
+	if shapeType == "transparent" {
+		seen := make(map[point]bool, len(transparentMapPoints))
+		for _, p := range transparentMapPoints {
+			if !seen[p] {
+				seen[p] = true
+				points = append(points, [2]int{p.x, p.y})
+			}
+		}
+		return points, nil
+	}
+	if !close {
+		return nil, InvalidShapeSvgStringError(svgString)
+	}
+	polygon, _, err := FilledSvgToPolygon(transparentMapPoints, "", math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	for y := range polygon {
+		for x := range polygon[y] {
+			if polygon[y][x] {
+				points = append(points, [2]int{x, y})
+			}
+		}
+	}
+	return points, nil
+}
+
 // remove shape from map struct mapPoints, return ink returned
 // args:
 // - svgString : passed from client
@@ -153,14 +226,17 @@ func AddShapeToMap(svgString string, publicKey string, shapeType string, minerIn
 // - DisconnectedError
 // - ShapeOwnerError
 // - OutofBoundError: if any point is outside canvas size, return error
-// - InvalidShapeSvgStringError: if given filled type with not closed shape
-func RemoveShapeFromMap(svgString string, publicKey string, shapeType string, mapPoints map[string]MapPoint) (ink int, err error) {
+// - InvalidShapeSvgStringError: if given filled type with not closed shape,
+//   or a string the parser can't read
+func RemoveShapeFromMap(svgString string, publicKey string, shapeType string, mapPoints map[string]MapPoint, canvasXMax int, canvasYMax int) (ink int, err error) {
+	defer recoverInvalidSvg(svgString, &err)
+	canvasMax := point{x: canvasXMax, y: canvasYMax}
 	var transparentMapPoints map[int]point
 	var polygon [][]bool
 	var close bool
 	//var close bool
 	if shapeType == "transparent" {
-		transparentMapPoints, ink, _, err = RemoveTransparentSvgToCoord(svgString, publicKey)
+		transparentMapPoints, ink, _, err = removeSvgToCoord(svgString, publicKey, canvasMax)
 		if err != nil {
 			fmt.Println(err)
 			return 0, err
@@ -179,7 +255,10 @@ func RemoveShapeFromMap(svgString string, publicKey string, shapeType string, ma
 		}
 		// filled
 	} else {
-		transparentMapPoints, _, close, err = RemoveTransparentSvgToCoord(svgString, publicKey)
+		transparentMapPoints, _, close, err = removeSvgToCoord(svgString, publicKey, canvasMax)
+		if _, ok := err.(OutOfBoundsError); ok {
+			return 0, err
+		}
 		if !close {
 			err = InvalidShapeSvgStringError(svgString)
 			fmt.Println(err)
@@ -228,6 +307,11 @@ func RemoveShapeFromMap(svgString string, publicKey string, shapeType string, ma
 // 1: OutofBoundError: if any point is outside canvas size, return error
 // 2: InsufficientInkError: if given minerInk is less then ink needed
 func TransparentSvgToCoord(svgString string, publicKey string, minerInk int) (localMapPoints map[int]point, ink int, close bool, err error) {
+	return svgToCoord(svgString, publicKey, minerInk, defaultCanvasMax)
+}
+
+// TransparentSvgToCoord for a canvas whose far corner is canvasMax.
+func svgToCoord(svgString string, publicKey string, minerInk int, canvasMax point) (localMapPoints map[int]point, ink int, close bool, err error) {
 	initialPoint := point{x: 0, y: 0}
 	endPoint := point{x: 0, y: 0}
 	currentPoint := point{x: 0, y: 0}
@@ -298,14 +382,15 @@ func TransparentSvgToCoord(svgString string, publicKey string, minerInk int) (lo
 					initialPoint.y = num + initialPoint.y
 					currentPoint.y = num + currentPoint.y
 				}
-				if !checkCanvasSize(currentPoint) {
-					err = OutOfBoundsError{}
-					return localMapPoints, ink, close, err
-				}
 				// println("y1")
 				// println(initialPoint.y)
 				s3 = ""
 			}
+			// A move with a missing y still moves x.
+			if !checkCanvasSize(currentPoint, canvasMax) {
+				err = OutOfBoundsError{}
+				return localMapPoints, ink, close, err
+			}
 		}
 		if s == "L" || s == "l" {
 			s2 := s
@@ -362,7 +447,7 @@ func TransparentSvgToCoord(svgString string, publicKey string, minerInk int) (lo
 				// println(temPoint.y)
 				s3 = ""
 			}
-			if !checkCanvasSize(temPoint) {
+			if !checkCanvasSize(temPoint, canvasMax) {
 				err = OutOfBoundsError{}
 				return localMapPoints, ink, close, err
 			}
@@ -412,7 +497,7 @@ func TransparentSvgToCoord(svgString string, publicKey string, minerInk int) (lo
 				// println(temPoint.x)
 				s3 = ""
 			}
-			if !checkCanvasSize(temPoint) {
+			if !checkCanvasSize(temPoint, canvasMax) {
 				err = OutOfBoundsError{}
 				return localMapPoints, ink, close, err
 			}
@@ -462,7 +547,7 @@ func TransparentSvgToCoord(svgString string, publicKey string, minerInk int) (lo
 				// println(num)
 				s3 = ""
 			}
-			if !checkCanvasSize(temPoint) {
+			if !checkCanvasSize(temPoint, canvasMax) {
 				err = OutOfBoundsError{}
 				return localMapPoints, ink, close, err
 			}
@@ -531,6 +616,11 @@ func TransparentSvgToCoord(svgString string, publicKey string, minerInk int) (lo
 // err error:
 // 1: OutofBoundError: if any point is outside canvas size, return error
 func RemoveTransparentSvgToCoord(svgString string, publicKey string) (localMapPoints map[int]point, ink int, close bool, err error) {
+	return removeSvgToCoord(svgString, publicKey, defaultCanvasMax)
+}
+
+// RemoveTransparentSvgToCoord for a canvas whose far corner is canvasMax.
+func removeSvgToCoord(svgString string, publicKey string, canvasMax point) (localMapPoints map[int]point, ink int, close bool, err error) {
 	initialPoint := point{x: 0, y: 0}
 	endPoint := point{x: 0, y: 0}
 	currentPoint := point{x: 0, y: 0}
@@ -601,14 +691,15 @@ func RemoveTransparentSvgToCoord(svgString string, publicKey string) (localMapPo
 					initialPoint.y = num + initialPoint.y
 					currentPoint.y = num + currentPoint.y
 				}
-				if !checkCanvasSize(currentPoint) {
-					err = OutOfBoundsError{}
-					return localMapPoints, ink, close, err
-				}
 				// println("y1")
 				// println(initialPoint.y)
 				s3 = ""
 			}
+			// A move with a missing y still moves x.
+			if !checkCanvasSize(currentPoint, canvasMax) {
+				err = OutOfBoundsError{}
+				return localMapPoints, ink, close, err
+			}
 		}
 		if s == "L" || s == "l" {
 			s2 := s
@@ -665,7 +756,7 @@ func RemoveTransparentSvgToCoord(svgString string, publicKey string) (localMapPo
 				// println(temPoint.y)
 				s3 = ""
 			}
-			if !checkCanvasSize(temPoint) {
+			if !checkCanvasSize(temPoint, canvasMax) {
 				err = OutOfBoundsError{}
 				return localMapPoints, ink, close, err
 			}
@@ -715,7 +806,7 @@ func RemoveTransparentSvgToCoord(svgString string, publicKey string) (localMapPo
 				// println(temPoint.x)
 				s3 = ""
 			}
-			if !checkCanvasSize(temPoint) {
+			if !checkCanvasSize(temPoint, canvasMax) {
 				err = OutOfBoundsError{}
 				return localMapPoints, ink, close, err
 			}
@@ -765,7 +856,7 @@ func RemoveTransparentSvgToCoord(svgString string, publicKey string) (localMapPo
 				// println(num)
 				s3 = ""
 			}
-			if !checkCanvasSize(temPoint) {
+			if !checkCanvasSize(temPoint, canvasMax) {
 				err = OutOfBoundsError{}
 				return localMapPoints, ink, close, err
 			}
@@ -942,10 +1033,12 @@ func getPointsFromVertex(x1 int, x2 int, y1 int, y2 int) []point {
 	return points
 }
 
-func checkCanvasSize(temPoint point) bool {
-	CanvasXMax := 1024
-	CanvasYMax := 1024
-	if temPoint.x > CanvasXMax || temPoint.x < 0 || temPoint.y > CanvasYMax || temPoint.y < 0 {
+// Far corner of the canvas TransparentSvgToCoord and
+// RemoveTransparentSvgToCoord draw on.
+var defaultCanvasMax = point{x: 1024, y: 1024}
+
+func checkCanvasSize(temPoint point, canvasMax point) bool {
+	if temPoint.x > canvasMax.x || temPoint.x < 0 || temPoint.y > canvasMax.y || temPoint.y < 0 {
 		return false
 	}
 	return true
@@ -1006,7 +1099,6 @@ func FilledSvgToPolygon(transparentMapPoints map[int]point, publicKey string, mi
 	}
 
 	//fmt.Printf("in polygon close and ink--------------------------------------------------------------\n")
-	println(ink)
 	if ink > minerInk {
 		ink32 := int32(ink)
 		//fmt.Printf("-------------------------------not enough ink---need %d----have %d-----------------\n", ink, minerInk)
@@ -0,0 +1,89 @@
+package SvgHelper
+
+import "testing"
+
+func TestShapeInk(t *testing.T) {
+	tests := []struct {
+		svg, shapeType string
+		ink            int
+		err            error
+	}{
+		{"M 0 0 L 5 0", "transparent", 6, nil},
+		{"M 1 1 H 3", "transparent", 3, nil},
+		{"M 0 0 L 0 0", "transparent", 1, nil},
+		{"M 0 0 h 5 v 5 h -5 z", "transparent", 20, nil},
+		{"M 0 0 h 5 v 5 h -5 z", "filled", 36, nil},
+		{"M 0 0 L 5 0", "filled", 0, InvalidShapeSvgStringError("M 0 0 L 5 0")},
+		{"M 0 0 L 200 0", "transparent", 0, OutOfBoundsError{}},
+		{"M", "transparent", 0, InvalidShapeSvgStringError("M")},
+		{"M 0 0 L", "transparent", 0, InvalidShapeSvgStringError("M 0 0 L")},
+		{"M 0 0 H", "transparent", 0, InvalidShapeSvgStringError("M 0 0 H")},
+		{"M 0 0 V", "transparent", 0, InvalidShapeSvgStringError("M 0 0 V")},
+	}
+	for _, test := range tests {
+		ink, err := ShapeInk(test.svg, test.shapeType, 100, 100)
+		if ink != test.ink || err != test.err {
+			t.Errorf("ShapeInk(%q, %q) = %d, %v; want %d, %v", test.svg, test.shapeType, ink, err, test.ink, test.err)
+		}
+	}
+}
+
+func TestShapePoints(t *testing.T) {
+	tests := []struct {
+		svg, shapeType string
+		points         [][2]int
+		err            error
+	}{
+		{"M 1 1 H 3", "transparent", [][2]int{{1, 1}, {2, 1}, {3, 1}}, nil},
+		{"M 0 0 L 0 2", "transparent", [][2]int{{0, 0}, {0, 1}, {0, 2}}, nil},
+		{"M 0 0 h 1 v 1 h -1 z", "filled", [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}}, nil},
+		{"M 0 0 L 200 0", "transparent", nil, OutOfBoundsError{}},
+		{"M", "transparent", nil, InvalidShapeSvgStringError("M")},
+		{"M 0 0 L", "transparent", nil, InvalidShapeSvgStringError("M 0 0 L")},
+		{"M 0 0 H", "filled", nil, InvalidShapeSvgStringError("M 0 0 H")},
+	}
+	for _, test := range tests {
+		points, err := ShapePoints(test.svg, test.shapeType, 100, 100)
+		if err != test.err || !samePoints(points, test.points) {
+			t.Errorf("ShapePoints(%q, %q) = %v, %v; want %v, %v", test.svg, test.shapeType, points, err, test.points, test.err)
+		}
+	}
+}
+
+// Transparent shapes come back in no particular order.
+func samePoints(got, want [][2]int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[[2]int]bool, len(got))
+	for _, p := range got {
+		seen[p] = true
+	}
+	for _, p := range want {
+		if !seen[p] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAddShapeToMapCanvasSize(t *testing.T) {
+	if _, err := AddShapeToMap("M 0 0 L 1500 0", "k", "transparent", 5000, map[string]MapPoint{}, 2048, 100); err != nil {
+		t.Error("Expected the shape to fit a 2048 wide canvas, got: ", err)
+	}
+	if _, err := AddShapeToMap("M 0 0 L 1500 0", "k", "transparent", 5000, map[string]MapPoint{}, 1024, 100); err != (OutOfBoundsError{}) {
+		t.Error("Expected OutOfBoundsError, got: ", err)
+	}
+}
+
+func TestMalformedDoesNotPanic(t *testing.T) {
+	for _, svg := range []string{"M", "M 0 0 L", "M 0 0 H", "M 0 0 V", "M 1"} {
+		mapPoints := make(map[string]MapPoint)
+		if _, err := AddShapeToMap(svg, "k", "transparent", 1000, mapPoints, 100, 100); err == nil {
+			t.Errorf("AddShapeToMap(%q): expected an error", svg)
+		}
+		if _, err := RemoveShapeFromMap(svg, "k", "transparent", mapPoints, 100, 100); err == nil {
+			t.Errorf("RemoveShapeFromMap(%q): expected an error", svg)
+		}
+	}
+}
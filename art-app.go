@@ -4,7 +4,10 @@ A trivial application to illustrate how the blockartlib library can be
 used from an application in project 1 for UBC CS 416 2017W2.
 
 Usage:
-go run art-app.go miner-addr privKey
+go run art-app.go miner-addr privKey|keyFile
+
+The key is either hex-encoded or the path of a key file made with
+blockart-keys.
 */
 
 package main
@@ -12,8 +15,7 @@ package main
 // Expects blockartlib.go to be in the ./blockartlib/ dir, relative to
 // this art-app.go file
 import (
-	"crypto/x509"
-	"encoding/hex"
+	"crypto/ecdsa"
 	"fmt"
 	"os"
 
@@ -22,16 +24,16 @@ import (
 
 func main() {
 	// minerAddr := "127.0.0.1:8088"
-	// privKey := // TODO: use crypto/ecdsa to read pub/priv keys from a file argument.
 
 	if len(os.Args) != 3 {
-		fmt.Println("Server address [ip:port] privatekeyString")
+		fmt.Println("Server address [ip:port] privatekeyString|privatekeyFile")
 		return
 	}
 	minerAddr := os.Args[1]
-	privString := os.Args[2]
-	privateKeyBytesRestored, _ := hex.DecodeString(privString)
-	privKey, _ := x509.ParseECPrivateKey(privateKeyBytesRestored)
+	privKey, err := loadKey(os.Args[2])
+	if checkError(err) != nil {
+		return
+	}
 
 	// Open a canvas.
 	// canvas, settings, err := blockartlib.OpenCanvas(minerAddr, *privKey)
@@ -73,6 +75,15 @@ func main() {
 	fmt.Println(ink4)
 }
 
+// Loads the key from a file if arg names one, and otherwise parses arg
+// as a hex-encoded key.
+func loadKey(arg string) (*ecdsa.PrivateKey, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return blockartlib.LoadPrivateKey(arg)
+	}
+	return blockartlib.ParsePrivateKey([]byte(arg))
+}
+
 // If error is non-nil, print it out and return it.
 func checkError(err error) error {
 	if err != nil {
@@ -3,21 +3,47 @@
 This package specifies the application's interface to the the BlockArt
 library (blockartlib) to be used in project 1 of UBC CS 416 2017W2.
 
+Every Canvas call has a variant taking a context.Context (AddShapeContext,
+GetInkContext, ...). These return ctx.Err() as soon as the context is
+cancelled or its deadline passes, without waiting for the miner; the
+abandoned call may still take effect on the miner. In all calls, losing
+the connection to the miner is reported as a DisconnectedError.
+
+A canvas can be opened on several miners that share the owner key. It
+talks to one of them at a time and switches to the next one that answers
+when that miner dies; a call only fails with a DisconnectedError once
+none of them do. An op that was sent but not answered is looked up on the
+new miner's chain first and only sent again if it is not there.
+
 */
 
 package blockartlib
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/rpc"
 	"os"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"../SvgHelper"
 )
 
 // Represents a type of shape in the BlockArt system.
@@ -65,7 +91,10 @@ type MinerNetSettings struct {
 }
 
 type MyCanvas struct {
+	mu             sync.Mutex // guards conn and minerAddr, which change on failover
 	conn           *rpc.Client
+	minerAddr      string
+	minerAddrs     []string
 	minerPrivKey   ecdsa.PrivateKey
 	CanvSetting    CanvasSettings
 	artnodePrivKey string
@@ -83,6 +112,9 @@ type ValidMiner struct {
 // for the kind of error that occurred. Each API call below lists the
 // errors that it is allowed to raise.
 //
+// Errors raised by the miner arrive as an errorEnvelope and are rebuilt
+// into these types, payload included.
+//
 // Also see:
 // https://blog.golang.org/error-handling-and-go
 // https://blog.golang.org/errors-are-values
@@ -157,6 +189,51 @@ func (e InvalidMinerPKError) Error() string {
 	return fmt.Sprintf("BlockArt: Invalid miner's private/public key [%s]", string(e))
 }
 
+// An error as the miner sends it. net/rpc only carries the text of an
+// error, so the miner JSON-encodes the error's type name and payload.
+type errorEnvelope struct {
+	Type    string
+	Payload string
+	Message string
+}
+
+// Rebuilds the error the miner raised from the text of a server error.
+// Errors that are not an envelope, or of a type this package doesn't
+// know, are returned as they are.
+func decodeError(err rpc.ServerError) error {
+	var env errorEnvelope
+	if json.Unmarshal([]byte(err), &env) != nil {
+		return err
+	}
+	switch env.Type {
+	case "DisconnectedError":
+		return DisconnectedError(env.Payload)
+	case "InsufficientInkError":
+		ink, perr := strconv.ParseUint(env.Payload, 10, 32)
+		if perr != nil {
+			return err
+		}
+		return InsufficientInkError(ink)
+	case "InvalidShapeSvgStringError":
+		return InvalidShapeSvgStringError(env.Payload)
+	case "ShapeSvgStringTooLongError":
+		return ShapeSvgStringTooLongError(env.Payload)
+	case "InvalidShapeHashError":
+		return InvalidShapeHashError(env.Payload)
+	case "ShapeOwnerError":
+		return ShapeOwnerError(env.Payload)
+	case "OutOfBoundsError":
+		return OutOfBoundsError{}
+	case "ShapeOverlapError":
+		return ShapeOverlapError(env.Payload)
+	case "InvalidBlockHashError":
+		return InvalidBlockHashError(env.Payload)
+	case "InvalidMinerPKError":
+		return InvalidMinerPKError(env.Payload)
+	}
+	return err
+}
+
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -209,6 +286,95 @@ type Canvas interface {
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
+
+	// Adds several shapes in one op block. The shapes are checked together
+	// for overlap and ink, and either all of them are added or none is.
+	// shapeHashes are in the order of shapes.
+	// Can return the same errors as AddShape.
+	AddShapes(validateNum uint8, shapes []ShapeSpec) (shapeHashes []string, blockHash string, inkRemaining uint32, err error)
+
+	// Submits a new shape without waiting for it to be confirmed. Returns
+	// as soon as the miner has put the op in a block; the returned
+	// PendingOp tracks its confirmations. Can return the same errors as
+	// AddShape.
+	SubmitShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error)
+
+	// Streams the changes to the miner's chain from its current tip on,
+	// until ctx is done. See Subscription.
+	// Can return the following errors:
+	// - DisconnectedError
+	Subscribe(ctx context.Context) (sub *Subscription, err error)
+
+	// Like Subscribe, but streams the changes after the block with the
+	// given hash, e.g. the last one seen before a restart; "" streams
+	// the whole chain. If the block is no longer in the miner's chain,
+	// the stream starts with a ReorgEvent.
+	// Can return the following errors:
+	// - DisconnectedError
+	SubscribeFrom(ctx context.Context, blockHash string) (sub *Subscription, err error)
+
+	// Checks the shape against the canvas settings from OpenCanvas the way
+	// the miner does, without contacting it. Overlap and ink depend on the
+	// chain and are left to the miner.
+	// Can return the following errors:
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - OutOfBoundsError
+	ValidateShape(shapeType ShapeType, shapeSvgString string, fill string, stroke string) error
+
+	// Returns the ink the shape would cost, without contacting the miner.
+	// fill is as in AddShape.
+	// Can return the following errors:
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - OutOfBoundsError
+	EstimateInk(shapeSvgString string, fill string) (ink uint32, err error)
+
+	// Returns the shapes on the canvas as of the block with the given
+	// hash, in the order they were added. The genesis block hash gives the
+	// empty canvas.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetCanvasState(blockHash string) (state CanvasState, err error)
+
+	// Returns the miner's view of the block with the given hash. The
+	// genesis block has index -1 and no miner, parent or ops.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetBlock(blockHash string) (block BlockSummary, err error)
+
+	// Returns the hash of the last block of the miner's chain, or of the
+	// genesis block if the chain is empty.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetChainTip() (blockHash string, err error)
+
+	// Returns where the shape was added, by which art node and miner, how
+	// many blocks confirm it, the ink it cost, and whether and where it
+	// was deleted.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetShapeInfo(shapeHash string) (info ShapeInfo, err error)
+
+	// Variants of the calls above that give up when ctx is done, returning
+	// ctx.Err(). They can return the same errors as the calls they mirror.
+	AddShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+	AddShapesContext(ctx context.Context, validateNum uint8, shapes []ShapeSpec) (shapeHashes []string, blockHash string, inkRemaining uint32, err error)
+	SubmitShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error)
+	GetSvgStringContext(ctx context.Context, shapeHash string) (svgString string, err error)
+	GetInkContext(ctx context.Context) (inkRemaining uint32, err error)
+	DeleteShapeContext(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
+	GetShapesContext(ctx context.Context, blockHash string) (shapeHashes []string, err error)
+	GetGenesisBlockContext(ctx context.Context) (blockHash string, err error)
+	GetChildrenContext(ctx context.Context, blockHash string) (blockHashes []string, err error)
+	CloseCanvasContext(ctx context.Context) (inkRemaining uint32, err error)
+	GetCanvasStateContext(ctx context.Context, blockHash string) (state CanvasState, err error)
+	GetBlockContext(ctx context.Context, blockHash string) (block BlockSummary, err error)
+	GetChainTipContext(ctx context.Context) (blockHash string, err error)
+	GetShapeInfoContext(ctx context.Context, shapeHash string) (info ShapeInfo, err error)
 }
 
 type AddShapeStruct struct {
@@ -226,12 +392,298 @@ type AddShapeReply struct {
 	InkRemaining uint32
 }
 
+// A shape to add with AddShapes; the fields are as in AddShape.
+type ShapeSpec struct {
+	ShapeType      ShapeType
+	ShapeSvgString string
+	Fill           string
+	Stroke         string
+}
+
+type AddShapesArgs struct {
+	ValidateNum uint8
+	Shapes      []ShapeSpec
+	ArtNodePK   string
+}
+
+type AddShapesReply struct {
+	ShapeHashes  []string
+	BlockHash    string
+	InkRemaining uint32
+}
+
 type DelShapeArgs struct {
 	ValidateNum uint8
 	ShapeHash   string
 	ArtNodePK   string
 }
 
+// Where an op is on the miner's chain: the first block holding it and the
+// number of blocks mined on top of that block.
+type OpStatus struct {
+	BlockHash string
+	Depth     int
+}
+
+// A shape submitted with SubmitShape. ShapeHash, BlockHash and
+// InkRemaining are as AddShape would return them; the op is confirmed once
+// ValidateNum blocks have been mined on top of BlockHash. If the canvas
+// fails over before the op reaches the new miner's chain, the op is
+// submitted there again and ends up in a different block.
+type PendingOp struct {
+	ShapeHash    string
+	BlockHash    string
+	InkRemaining uint32
+	ValidateNum  uint8
+
+	canvas    *MyCanvas
+	args      AddShapeStruct
+	minerAddr string // miner the op was last submitted to or found on
+	done      chan struct{}
+
+	mu    sync.Mutex
+	depth int
+	err   error
+}
+
+// How often a PendingOp asks the miner for its confirmation depth.
+const confirmationPollInterval = time.Second
+
+// Returns the number of blocks mined on top of the op's block so far.
+func (op *PendingOp) Depth() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.depth
+}
+
+// Returns a channel that is closed once the op is confirmed or has failed
+// (see Err).
+func (op *PendingOp) Done() <-chan struct{} {
+	return op.done
+}
+
+// Returns nil if the op was confirmed and the reason otherwise, once Done
+// is closed; before that it returns nil. An InvalidShapeHashError means the
+// op's block was dropped from the miner's chain, or the shape was deleted.
+func (op *PendingOp) Err() error {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.err
+}
+
+// Blocks until the op is confirmed or has failed, or ctx is done.
+func (op *PendingOp) Wait(ctx context.Context) error {
+	select {
+	case <-op.done:
+		return op.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Polls the miner until the op reaches ValidateNum confirmations or can no
+// longer be followed.
+func (op *PendingOp) follow() {
+	defer close(op.done)
+	c := op.canvas
+	for {
+		var status OpStatus
+		err := c.call(context.Background(), "InkMinerRPC.GetConfirmations", op.ShapeHash, &status)
+		_, addr := c.current()
+		if err == nil {
+			op.minerAddr = addr
+		} else if isInvalidShapeHash(err) && addr != op.minerAddr {
+			// The canvas failed over before the op reached the new
+			// miner's chain, so submit it there.
+			_, err = c.callOp(context.Background(), "InkMinerRPC.SubmitShape", op.args, &AddShapeReply{}, op.ShapeHash)
+			_, op.minerAddr = c.current()
+			if err == nil {
+				continue
+			}
+		}
+
+		op.mu.Lock()
+		if err == nil {
+			op.depth = status.Depth
+		}
+		op.err = err
+		op.mu.Unlock()
+
+		if err != nil || status.Depth >= int(op.ValidateNum) {
+			return
+		}
+		time.Sleep(confirmationPollInterval)
+	}
+}
+
+// Kinds of CanvasEvent.
+type EventType int
+
+const (
+	// A block was added to the chain.
+	NewBlockEvent EventType = iota
+
+	// A shape was added in the block BlockHash.
+	ShapeAddedEvent
+
+	// A shape was deleted in the block BlockHash.
+	ShapeDeletedEvent
+
+	// The miner switched to a chain without some of the blocks already
+	// delivered. BlockHash is the newest delivered block still in the
+	// chain ("" if there is none); the events of the blocks after it
+	// follow.
+	ReorgEvent
+)
+
+// A change to the canvas, delivered by a Subscription.
+type CanvasEvent struct {
+	Type        EventType
+	BlockHash   string
+	BlockIndex  int
+	MinerPubKey string // key of the miner that mined BlockHash
+
+	// For shape events.
+	ShapeHash string
+	SvgString string // only for ShapeAddedEvent
+	Fill      string // only for ShapeAddedEvent
+}
+
+type WatchArgs struct {
+	Known   []string
+	FromTip bool
+	Wait    int
+}
+
+type WatchReply struct {
+	Tip    string
+	Events []CanvasEvent
+}
+
+// A stream of canvas events from Subscribe. Events are delivered in chain
+// order on their own connection to the miner, which is redialled (resuming
+// after the last delivered block) if it breaks. If the miner can't be
+// dialled the canvas fails over and the stream resumes on the new miner.
+// Events is closed once the subscription's context is done or the stream
+// fails for good; Err tells which.
+type Subscription struct {
+	Events <-chan CanvasEvent
+
+	canvas *MyCanvas
+	known  []string // delivered block hashes, newest first
+
+	mu  sync.Mutex // guards err
+	err error      // why Events was closed
+}
+
+const (
+	// How long the miner holds a WatchChain call open waiting for blocks.
+	watchWait = 30 * time.Second
+
+	// Delivered block hashes a Subscription remembers to find where the
+	// chain forked.
+	maxKnownBlocks = 64
+
+	// Longest wait between attempts to reach the miner again.
+	maxResubscribeBackoff = 10 * time.Second
+
+	// Attempts in a row in which no miner could be reached before a
+	// Subscription gives up.
+	maxResubscribeFailures = 5
+)
+
+// The shapes on the canvas as of a block, from GetCanvasState.
+type CanvasState struct {
+	BlockHash string
+	Shapes    []CanvasShape
+}
+
+// A shape on the canvas.
+type CanvasShape struct {
+	ShapeHash      string
+	SvgString      string // the whole <path> element, as GetSvgString returns it
+	ShapeSvgString string // the path data, as passed to AddShape
+	Fill           string
+	Stroke         string
+	Owner          string // ArtNodeID of the art node that added the shape
+	Ink            uint32 // ink the shape cost
+	Bounds         Rect   // smallest rectangle holding the shape
+
+	points [][2]int
+}
+
+// A rectangle on the canvas. Both corners are part of it.
+type Rect struct {
+	MinX, MinY int
+	MaxX, MaxY int
+}
+
+func (r Rect) contains(x, y int) bool {
+	return x >= r.MinX && x <= r.MaxX && y >= r.MinY && y <= r.MaxY
+}
+
+func (r Rect) overlaps(o Rect) bool {
+	return r.MinX <= o.MaxX && o.MinX <= r.MaxX && r.MinY <= o.MaxY && o.MinY <= r.MaxY
+}
+
+// Returns the shapes that cover at least one point of r.
+func (s CanvasState) Intersecting(r Rect) []CanvasShape {
+	var shapes []CanvasShape
+	for _, shape := range s.Shapes {
+		if !shape.Bounds.overlaps(r) {
+			continue
+		}
+		for _, p := range shape.points {
+			if r.contains(p[0], p[1]) {
+				shapes = append(shapes, shape)
+				break
+			}
+		}
+	}
+	return shapes
+}
+
+// Returns the shapes that cover the point x, y.
+func (s CanvasState) At(x, y int) []CanvasShape {
+	return s.Intersecting(Rect{x, y, x, y})
+}
+
+// A block of the chain, from GetBlock.
+type BlockSummary struct {
+	Hash        string
+	PrevHash    string
+	Index       int // position in the chain; -1 for the genesis block
+	Nonce       uint32
+	NoOpBlock   bool
+	MinerPubKey string      // public key of the miner that mined the block
+	Ops         []OpSummary // the ops this block added, in order
+}
+
+// An op in a block.
+type OpSummary struct {
+	ShapeHash string
+	Delete    bool   // the op deletes ShapeHash rather than adding it
+	SvgString string // the added shape's <path> element
+	Owner     string // id of the art node that sent the op, as in CanvasShape
+}
+
+// Where a shape came from and what became of it, from GetShapeInfo.
+type ShapeInfo struct {
+	ShapeHash        string
+	SvgString        string // the whole <path> element, as GetSvgString returns it
+	ShapeSvgString   string // the path data, as passed to AddShape
+	Fill             string
+	Owner            string // id of the art node that added the shape, as in CanvasShape
+	MinerPubKey      string // public key of the miner of BlockHash
+	BlockHash        string // block that added the shape
+	BlockIndex       int
+	Depth            int    // number of blocks on top of BlockHash
+	Ink              uint32 // ink the shape cost
+	Deleted          bool
+	DeleteBlockHash  string // block that deleted the shape, if Deleted
+	DeleteBlockIndex int
+}
+
 type CloseCanvReply struct {
 	CanvOps      map[string][]string
 	InkRemaining uint32
@@ -250,37 +702,102 @@ type Operation struct {
 // key type contains the public key). Returns a Canvas instance that
 // can be used for all future interactions with blockartlib.
 //
+// minerAddr may list several comma-separated miners that all mine for
+// privKey; the canvas fails over between them. Each one is checked at
+// open: a miner with a different key or canvas fails the open, while
+// unreachable ones are skipped as long as one answers.
+//
 // The returned Canvas instance is a singleton: an application is
 // expected to interact with just one Canvas instance at a time.
 //
 // Can return the following errors:
 // - DisconnectedError
 func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
+	return OpenCanvasContext(context.Background(), minerAddr, privKey)
+}
 
-	c, err := rpc.Dial("tcp", minerAddr)
-	if err != nil {
-		return canvas, CanvasSettings{}, DisconnectedError("rpc dial")
+// Like OpenCanvas, but gives up connecting when ctx is done.
+func OpenCanvasContext(ctx context.Context, minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
+	var addrs []string
+	for _, addr := range strings.Split(minerAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return canvas, CanvasSettings{}, DisconnectedError(minerAddr)
 	}
 
 	artnodePK, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-	var validMiner *ValidMiner
-	validMiner = &ValidMiner{}
-	privKeyInString := getPrivKeyInStr(privKey)
-	err = c.Call("InkMinerRPC.Connect", privKeyInString, &validMiner)
+	if err != nil {
+		return canvas, CanvasSettings{}, err
+	}
+	canv := &MyCanvas{
+		minerAddrs:     addrs,
+		minerPrivKey:   privKey,
+		artnodePrivKey: getPrivKeyInStr(*artnodePK),
+	}
 
-	if !(*validMiner).Valid {
-		return canvas, CanvasSettings{}, DisconnectedError("invalid miner key")
+	for _, addr := range addrs {
+		conn, setting, err := connectMiner(ctx, addr, privKey)
+		if err == nil && canv.conn == nil {
+			canv.conn, canv.minerAddr, canv.CanvSetting = conn, addr, setting
+			continue
+		}
+		if err == nil {
+			// Only the first healthy miner is kept connected; the rest
+			// are dialled again on failover.
+			conn.Close()
+			if setting != canv.CanvSetting {
+				err = DisconnectedError("miner " + addr + " has different canvas settings")
+			}
+		}
+		if err == nil || err == DisconnectedError(addr) {
+			continue
+		}
+		if canv.conn != nil {
+			canv.conn.Close()
+		}
+		return canvas, CanvasSettings{}, err
 	}
-	if err != nil {
-		return canvas, CanvasSettings{}, DisconnectedError("InkMinerRPC.Connect")
+	if canv.conn == nil {
+		return canvas, CanvasSettings{}, DisconnectedError(minerAddr)
 	}
+	return canv, canv.CanvSetting, nil
+}
+
+// Returned when a miner does not mine for the canvas owner's key.
+var errInvalidMinerKey = DisconnectedError("invalid miner key")
 
-	setting = (*validMiner).CanvSetting
-	artPkinStr := getPrivKeyInStr(*artnodePK)
-	canv := MyCanvas{c, privKey, (*validMiner).CanvSetting, artPkinStr}
-	//fmt.Println("PPPPPPPPPPPPPP###", (*validMiner).CanvSetting)
-	canvas = &canv
-	return canvas, setting, err
+// Dials the miner at addr and checks that it mines for privKey.
+func connectMiner(ctx context.Context, addr string, privKey ecdsa.PrivateKey) (*rpc.Client, CanvasSettings, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, CanvasSettings{}, ctx.Err()
+		}
+		return nil, CanvasSettings{}, DisconnectedError(addr)
+	}
+	conn := rpc.NewClient(netConn)
+
+	validMiner := ValidMiner{}
+	err = callOn(ctx, conn, addr, "InkMinerRPC.Connect", getPrivKeyInStr(privKey), &validMiner)
+	switch err.(type) {
+	case InvalidMinerPKError:
+		err = errInvalidMinerKey
+	case DisconnectedError:
+		err = DisconnectedError(addr)
+	case nil:
+		if !validMiner.Valid {
+			err = errInvalidMinerKey
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, CanvasSettings{}, err
+	}
+	return conn, validMiner.CanvSetting, nil
 }
 
 //======================================================================
@@ -296,27 +813,135 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 // - ShapeOverlapError
 // - OutOfBoundsError
 func (c *MyCanvas) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
-	if len(shapeSvgString) > 128 {
-		return "", "", 0, ShapeSvgStringTooLongError(shapeSvgString)
+	return c.AddShapeContext(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+func (c *MyCanvas) AddShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	if err := c.ValidateShape(shapeType, shapeSvgString, fill, stroke); err != nil {
+		return "", "", 0, err
+	}
+
+	args := AddShapeStruct{validateNum, shapeType, shapeSvgString, fill, stroke, c.artnodePrivKey}
+	reply := AddShapeReply{}
+	shapeHash = c.shapeHash(ShapeSpec{shapeType, shapeSvgString, fill, stroke})
+	found, err := c.callOp(ctx, "InkMinerRPC.AddShape", args, &reply, shapeHash)
+	if found != nil {
+		blockHash, inkRemaining, err = c.awaitOp(ctx, shapeHash, validateNum)
+		return shapeHash, blockHash, inkRemaining, err
+	}
+	return reply.ShapeHash, reply.BlockHash, reply.InkRemaining, err
+}
+
+// Adds several shapes in one op block, all or nothing.
+// Can return the same errors as AddShape.
+func (c *MyCanvas) AddShapes(validateNum uint8, shapes []ShapeSpec) (shapeHashes []string, blockHash string, inkRemaining uint32, err error) {
+	return c.AddShapesContext(context.Background(), validateNum, shapes)
+}
+
+func (c *MyCanvas) AddShapesContext(ctx context.Context, validateNum uint8, shapes []ShapeSpec) (shapeHashes []string, blockHash string, inkRemaining uint32, err error) {
+	if len(shapes) == 0 {
+		return nil, "", 0, InvalidShapeSvgStringError("no shapes to add")
+	}
+	for _, shape := range shapes {
+		if err := c.ValidateShape(shape.ShapeType, shape.ShapeSvgString, shape.Fill, shape.Stroke); err != nil {
+			return nil, "", 0, err
+		}
+	}
+
+	args := AddShapesArgs{validateNum, shapes, c.artnodePrivKey}
+	reply := AddShapesReply{}
+	found, err := c.callOp(ctx, "InkMinerRPC.AddShapes", args, &reply, c.shapeHash(shapes[0]))
+	if found != nil {
+		for _, shape := range shapes {
+			shapeHashes = append(shapeHashes, c.shapeHash(shape))
+		}
+		blockHash, inkRemaining, err = c.awaitOp(ctx, shapeHashes[0], validateNum)
+		return shapeHashes, blockHash, inkRemaining, err
+	}
+	return reply.ShapeHashes, reply.BlockHash, reply.InkRemaining, err
+}
+
+// Submits a new shape without waiting for it to be confirmed.
+// Can return the same errors as AddShape.
+func (c *MyCanvas) SubmitShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error) {
+	return c.SubmitShapeContext(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+func (c *MyCanvas) SubmitShapeContext(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error) {
+	if err := c.ValidateShape(shapeType, shapeSvgString, fill, stroke); err != nil {
+		return nil, err
+	}
+
+	args := AddShapeStruct{validateNum, shapeType, shapeSvgString, fill, stroke, c.artnodePrivKey}
+	reply := AddShapeReply{}
+	shapeHash := c.shapeHash(ShapeSpec{shapeType, shapeSvgString, fill, stroke})
+	found, err := c.callOp(ctx, "InkMinerRPC.SubmitShape", args, &reply, shapeHash)
+	if err != nil {
+		return nil, err
+	}
+	if found != nil {
+		reply.ShapeHash = shapeHash
+		if reply.BlockHash, reply.InkRemaining, err = c.awaitOp(ctx, shapeHash, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	_, minerAddr := c.current()
+	op = &PendingOp{
+		ShapeHash:    reply.ShapeHash,
+		BlockHash:    reply.BlockHash,
+		InkRemaining: reply.InkRemaining,
+		ValidateNum:  validateNum,
+		canvas:       c,
+		args:         args,
+		minerAddr:    minerAddr,
+		done:         make(chan struct{}),
+	}
+	go op.follow()
+	return op, nil
+}
+
+// Checks the shape against the canvas settings without the miner.
+// Can return the following errors:
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - OutOfBoundsError
+func (c *MyCanvas) ValidateShape(shapeType ShapeType, shapeSvgString string, fill string, stroke string) error {
+	if shapeType != PATH {
+		return InvalidShapeSvgStringError("unknown shape type")
 	}
 	if stroke == fill && fill == "transparent" {
-		println("-----------------------------------------------------")
-		return "", "", 0, InvalidShapeSvgStringError("fill and stroke can't both be transparent")
+		return InvalidShapeSvgStringError("fill and stroke can't both be transparent")
 	}
 	if onlyWhiteSpace(stroke) || onlyWhiteSpace(fill) || (fill != "fill" && fill != "transparent") {
-		println("-----------------------------------------------------")
-		return "", "", 0, InvalidShapeSvgStringError("fill and stroke can't be empty")
+		return InvalidShapeSvgStringError("fill and stroke can't be empty")
 	}
-	// err1 := validSvgCommand(shapeSvgString)
-	// if err1 != nil {
-	// 	return "", "", 0, err1
-	// }
+	_, err := c.EstimateInk(shapeSvgString, fill)
+	return err
+}
 
-	args := AddShapeStruct{1, shapeType, shapeSvgString, fill, stroke, c.artnodePrivKey}
-	reply := AddShapeReply{}
-	err = c.conn.Call("InkMinerRPC.AddShape", args, &reply)
-	// fmt.Println("@@@", reply.ShapeHash)
-	return reply.ShapeHash, reply.BlockHash, reply.InkRemaining, err
+// Returns the ink the shape would cost, parsing it with the miner's
+// SvgHelper.
+// Can return the following errors:
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - OutOfBoundsError
+func (c *MyCanvas) EstimateInk(shapeSvgString string, fill string) (ink uint32, err error) {
+	if len(shapeSvgString) > 128 {
+		return 0, ShapeSvgStringTooLongError(shapeSvgString)
+	}
+	if err := validSvgCommand(shapeSvgString); err != nil {
+		return 0, err
+	}
+
+	n, err := SvgHelper.ShapeInk(shapeSvgString, fill, int(c.CanvSetting.CanvasXMax), int(c.CanvSetting.CanvasYMax))
+	switch err.(type) {
+	case nil:
+		return uint32(n), nil
+	case SvgHelper.OutOfBoundsError:
+		return 0, OutOfBoundsError{}
+	}
+	return 0, InvalidShapeSvgStringError(shapeSvgString)
 }
 
 // Returns the encoding of the shape as an svg string.
@@ -324,9 +949,11 @@ func (c *MyCanvas) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgStri
 // - DisconnectedError
 // - InvalidShapeHashError
 func (c *MyCanvas) GetSvgString(shapeHash string) (svgString string, err error) {
-	var reply string
-	err = c.conn.Call("InkMinerRPC.GetSvgString", shapeHash, &reply)
-	svgString = reply
+	return c.GetSvgStringContext(context.Background(), shapeHash)
+}
+
+func (c *MyCanvas) GetSvgStringContext(ctx context.Context, shapeHash string) (svgString string, err error) {
+	err = c.call(ctx, "InkMinerRPC.GetSvgString", shapeHash, &svgString)
 	return svgString, err
 }
 
@@ -334,20 +961,99 @@ func (c *MyCanvas) GetSvgString(shapeHash string) (svgString string, err error)
 // Can return the following errors:
 // - DisconnectedError
 func (c *MyCanvas) GetInk() (inkRemaining uint32, err error) {
+	return c.GetInkContext(context.Background())
+}
+
+func (c *MyCanvas) GetInkContext(ctx context.Context) (inkRemaining uint32, err error) {
 	mpk := getPrivKeyInStr(c.minerPrivKey)
-	err = c.conn.Call("InkMinerRPC.GetInk", mpk, &inkRemaining)
+	err = c.call(ctx, "InkMinerRPC.GetInk", mpk, &inkRemaining)
 	return inkRemaining, err
 }
 
-// Removes a shape from the canvas.
+// Removes a shape from the canvas. If the miner is lost before it
+// answers, the delete is only sent again if the next miner's chain does not
+// already have it; if it does, the delete succeeds once it has validateNum
+// confirmations there.
 // Can return the following errors:
 // - DisconnectedError
 // - ShapeOwnerError
 func (c *MyCanvas) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
+	return c.DeleteShapeContext(context.Background(), validateNum, shapeHash)
+}
+
+func (c *MyCanvas) DeleteShapeContext(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
 	args := DelShapeArgs{validateNum, shapeHash, c.artnodePrivKey}
+	for {
+		conn, addr := c.current()
+		err = callOn(ctx, conn, addr, "InkMinerRPC.DeleteShape", args, &inkRemaining)
+		if _, ok := err.(DisconnectedError); !ok {
+			return inkRemaining, err
+		}
+		if err := c.failover(ctx, conn); err != nil {
+			return 0, err
+		}
 
-	err = c.conn.Call("InkMinerRPC.DeleteShape", args, &inkRemaining)
-	return inkRemaining, err
+		// The delete may have got through before the miner was lost.
+		for {
+			var info ShapeInfo
+			if err := c.call(ctx, "InkMinerRPC.GetShapeInfo", shapeHash, &info); err != nil {
+				return 0, err
+			}
+			if !info.Deleted {
+				break
+			}
+			if info.BlockIndex+info.Depth-info.DeleteBlockIndex >= int(validateNum) {
+				return c.GetInkContext(ctx)
+			}
+			select {
+			case <-time.After(confirmationPollInterval):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+	}
+}
+
+// Returns the shapes on the canvas as of the block with the given hash.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+func (c *MyCanvas) GetCanvasState(blockHash string) (state CanvasState, err error) {
+	return c.GetCanvasStateContext(context.Background(), blockHash)
+}
+
+func (c *MyCanvas) GetCanvasStateContext(ctx context.Context, blockHash string) (state CanvasState, err error) {
+	var shapes []CanvasShape
+	if err := c.call(ctx, "InkMinerRPC.GetCanvasState", blockHash, &shapes); err != nil {
+		return CanvasState{}, err
+	}
+
+	// Ink and extent are worked out here rather than sent by the miner.
+	for i := range shapes {
+		shape := &shapes[i]
+		points, err := SvgHelper.ShapePoints(shape.ShapeSvgString, shape.Fill, int(c.CanvSetting.CanvasXMax), int(c.CanvSetting.CanvasYMax))
+		if err != nil || len(points) == 0 {
+			continue
+		}
+		shape.points = points
+		shape.Ink, _ = c.EstimateInk(shape.ShapeSvgString, shape.Fill)
+		shape.Bounds = Rect{points[0][0], points[0][1], points[0][0], points[0][1]}
+		for _, p := range points[1:] {
+			if p[0] < shape.Bounds.MinX {
+				shape.Bounds.MinX = p[0]
+			}
+			if p[0] > shape.Bounds.MaxX {
+				shape.Bounds.MaxX = p[0]
+			}
+			if p[1] < shape.Bounds.MinY {
+				shape.Bounds.MinY = p[1]
+			}
+			if p[1] > shape.Bounds.MaxY {
+				shape.Bounds.MaxY = p[1]
+			}
+		}
+	}
+	return CanvasState{blockHash, shapes}, nil
 }
 
 // Retrieves hashes contained by a specific block.
@@ -355,8 +1061,11 @@ func (c *MyCanvas) DeleteShape(validateNum uint8, shapeHash string) (inkRemainin
 // - DisconnectedError
 // - InvalidBlockHashError
 func (c *MyCanvas) GetShapes(blockHash string) (shapeHashes []string, err error) {
-	err = c.conn.Call("InkMinerRPC.GetShapes", blockHash, &shapeHashes)
-	// fmt.Println(shapeHashes, "SSSSSSS2222lib!!!")
+	return c.GetShapesContext(context.Background(), blockHash)
+}
+
+func (c *MyCanvas) GetShapesContext(ctx context.Context, blockHash string) (shapeHashes []string, err error) {
+	err = c.call(ctx, "InkMinerRPC.GetShapes", blockHash, &shapeHashes)
 	return shapeHashes, err
 }
 
@@ -364,8 +1073,12 @@ func (c *MyCanvas) GetShapes(blockHash string) (shapeHashes []string, err error)
 // Can return the following errors:
 // - DisconnectedError
 func (c *MyCanvas) GetGenesisBlock() (blockHash string, err error) {
+	return c.GetGenesisBlockContext(context.Background())
+}
+
+func (c *MyCanvas) GetGenesisBlockContext(ctx context.Context) (blockHash string, err error) {
 	arg := 0
-	err = c.conn.Call("InkMinerRPC.GetGenesisBlock", arg, &blockHash)
+	err = c.call(ctx, "InkMinerRPC.GetGenesisBlock", arg, &blockHash)
 	return blockHash, err
 }
 
@@ -374,22 +1087,70 @@ func (c *MyCanvas) GetGenesisBlock() (blockHash string, err error) {
 // - DisconnectedError
 // - InvalidBlockHashError
 func (c *MyCanvas) GetChildren(blockHash string) (blockHashes []string, err error) {
+	return c.GetChildrenContext(context.Background(), blockHash)
+}
 
-	err = c.conn.Call("InkMinerRPC.GetChildren", blockHash, &blockHashes)
+func (c *MyCanvas) GetChildrenContext(ctx context.Context, blockHash string) (blockHashes []string, err error) {
+	err = c.call(ctx, "InkMinerRPC.GetChildren", blockHash, &blockHashes)
 	return blockHashes, err
 }
 
+// Returns the miner's view of the block with the given hash.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+func (c *MyCanvas) GetBlock(blockHash string) (block BlockSummary, err error) {
+	return c.GetBlockContext(context.Background(), blockHash)
+}
+
+func (c *MyCanvas) GetBlockContext(ctx context.Context, blockHash string) (block BlockSummary, err error) {
+	err = c.call(ctx, "InkMinerRPC.GetBlock", blockHash, &block)
+	return block, err
+}
+
+// Returns the hash of the last block of the miner's chain.
+// Can return the following errors:
+// - DisconnectedError
+func (c *MyCanvas) GetChainTip() (blockHash string, err error) {
+	return c.GetChainTipContext(context.Background())
+}
+
+func (c *MyCanvas) GetChainTipContext(ctx context.Context) (blockHash string, err error) {
+	arg := 0
+	err = c.call(ctx, "InkMinerRPC.GetChainTip", arg, &blockHash)
+	return blockHash, err
+}
+
+// Returns where the shape came from and what became of it.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (c *MyCanvas) GetShapeInfo(shapeHash string) (info ShapeInfo, err error) {
+	return c.GetShapeInfoContext(context.Background(), shapeHash)
+}
+
+func (c *MyCanvas) GetShapeInfoContext(ctx context.Context, shapeHash string) (info ShapeInfo, err error) {
+	if err = c.call(ctx, "InkMinerRPC.GetShapeInfo", shapeHash, &info); err != nil {
+		return ShapeInfo{}, err
+	}
+	info.Ink, _ = c.EstimateInk(info.ShapeSvgString, info.Fill)
+	return info, nil
+}
+
 // Closes the canvas/connection to the BlockArt network.
 // - DisconnectedError
 func (c *MyCanvas) CloseCanvas() (inkRemaining uint32, err error) {
-	args := 0
+	return c.CloseCanvasContext(context.Background())
+}
 
-	var reply *CloseCanvReply
-	reply = &CloseCanvReply{}
+func (c *MyCanvas) CloseCanvasContext(ctx context.Context) (inkRemaining uint32, err error) {
+	args := 0
+	reply := CloseCanvReply{}
+	if err = c.call(ctx, "InkMinerRPC.CloseCanvas", args, &reply); err != nil {
+		return 0, err
+	}
 
-	err = c.conn.Call("InkMinerRPC.CloseCanvas", args, &reply)
-	ops := (*reply).CanvOps
-	//fmt.Println("CC:", *reply)
+	ops := reply.CanvOps
 	tmpMap := make(map[string]string)
 	height := fmt.Sprint(c.CanvSetting.CanvasYMax)
 	width := fmt.Sprint(c.CanvSetting.CanvasXMax)
@@ -417,8 +1178,408 @@ func (c *MyCanvas) CloseCanvas() (inkRemaining uint32, err error) {
 
 	d1 := []byte(html)
 	saveOnDisk(d1)
-	inkRemaining = (*reply).InkRemaining
-	return inkRemaining, err
+	return reply.InkRemaining, nil
+}
+
+// Streams the changes to the miner's chain from its current tip on.
+// Can return the following errors:
+// - DisconnectedError
+func (c *MyCanvas) Subscribe(ctx context.Context) (sub *Subscription, err error) {
+	var reply WatchReply
+	if err := c.call(ctx, "InkMinerRPC.WatchChain", WatchArgs{FromTip: true}, &reply); err != nil {
+		return nil, err
+	}
+	return c.SubscribeFrom(ctx, reply.Tip)
+}
+
+// Streams the changes to the miner's chain after blockHash.
+// Can return the following errors:
+// - DisconnectedError
+func (c *MyCanvas) SubscribeFrom(ctx context.Context, blockHash string) (sub *Subscription, err error) {
+	events := make(chan CanvasEvent)
+	sub = &Subscription{Events: events, canvas: c}
+	if blockHash != "" {
+		sub.known = []string{blockHash}
+	}
+	client, err := sub.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go sub.run(ctx, client, events)
+	return sub, nil
+}
+
+// Opens a connection to the canvas's current miner, failing over if it
+// can't be reached.
+func (s *Subscription) dial(ctx context.Context) (*rpc.Client, error) {
+	for {
+		current, addr := s.canvas.current()
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return rpc.NewClient(conn), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err := s.canvas.failover(ctx, current); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Returns why Events was closed: the subscription's context error, a
+// DisconnectedError if no miner could be reached maxResubscribeFailures
+// times in a row, or an error the miner raised for the watch. Returns nil
+// while Events is open.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) run(ctx context.Context, client *rpc.Client, events chan<- CanvasEvent) {
+	var err error
+	defer close(events)
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+	}()
+
+	backoff := 100 * time.Millisecond
+	failures := 0
+	for ctx.Err() == nil {
+		if client == nil {
+			var dialErr error
+			if client, dialErr = s.dial(ctx); dialErr != nil {
+				// dial already tried every miner.
+				if failures++; failures >= maxResubscribeFailures && ctx.Err() == nil {
+					err = dialErr
+					return
+				}
+				backoff = sleepBackoff(ctx, backoff, maxResubscribeBackoff)
+				continue
+			}
+			failures = 0
+		}
+
+		var reply WatchReply
+		args := WatchArgs{Known: s.known, Wait: int(watchWait / time.Millisecond)}
+		call := client.Go("InkMinerRPC.WatchChain", args, &reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			return
+		}
+		if serverErr, ok := call.Error.(rpc.ServerError); ok {
+			// A miner that is shutting down is left for another one;
+			// anything else it raises would be raised again.
+			if _, lost := decodeError(serverErr).(DisconnectedError); !lost {
+				err = decodeError(serverErr)
+				return
+			}
+		}
+		if call.Error != nil {
+			client.Close()
+			client = nil
+			backoff = sleepBackoff(ctx, backoff, maxResubscribeBackoff)
+			continue
+		}
+		backoff = 100 * time.Millisecond
+
+		for _, event := range reply.Events {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+			s.delivered(event)
+		}
+	}
+}
+
+// Keeps track of the delivered blocks, so that the miner can tell where to
+// resume after a reconnect or a fork.
+func (s *Subscription) delivered(event CanvasEvent) {
+	switch event.Type {
+	case NewBlockEvent:
+		s.known = append([]string{event.BlockHash}, s.known...)
+		if len(s.known) > maxKnownBlocks {
+			s.known = s.known[:maxKnownBlocks]
+		}
+	case ReorgEvent:
+		for i, hash := range s.known {
+			if hash == event.BlockHash {
+				s.known = s.known[i:]
+				return
+			}
+		}
+		s.known = nil
+	}
+}
+
+// Sleeps for backoff or until ctx is done, and returns the next backoff.
+func sleepBackoff(ctx context.Context, backoff, max time.Duration) time.Duration {
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+	}
+	if backoff *= 2; backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// Makes an RPC call to the current miner, failing over to the next one
+// and trying again if the connection is lost. Only used for calls that are
+// safe to repeat.
+func (c *MyCanvas) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	for {
+		conn, addr := c.current()
+		err := callOn(ctx, conn, addr, method, args, reply)
+		if _, ok := err.(DisconnectedError); !ok {
+			return err
+		}
+		if err := c.failover(ctx, conn); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends an op to the current miner. If the miner is lost before it
+// answers, the canvas fails over and looks shapeHash up on the new miner's
+// chain; the op is only sent again if it is not there, so that it is never
+// applied twice. If it is, its status there is returned instead of reply.
+func (c *MyCanvas) callOp(ctx context.Context, method string, args interface{}, reply interface{}, shapeHash string) (found *OpStatus, err error) {
+	for {
+		conn, addr := c.current()
+		err := callOn(ctx, conn, addr, method, args, reply)
+		if _, ok := err.(DisconnectedError); !ok {
+			return nil, err
+		}
+		if err := c.failover(ctx, conn); err != nil {
+			return nil, err
+		}
+
+		var status OpStatus
+		err = c.call(ctx, "InkMinerRPC.GetConfirmations", shapeHash, &status)
+		if err == nil {
+			return &status, nil
+		}
+		if !isInvalidShapeHash(err) {
+			return nil, err
+		}
+	}
+}
+
+// Waits for an op that callOp found on the chain to reach validateNum
+// confirmations and returns its block and the ink left, as the miner would
+// have.
+func (c *MyCanvas) awaitOp(ctx context.Context, shapeHash string, validateNum uint8) (blockHash string, inkRemaining uint32, err error) {
+	for {
+		var status OpStatus
+		if err := c.call(ctx, "InkMinerRPC.GetConfirmations", shapeHash, &status); err != nil {
+			return "", 0, err
+		}
+		if status.Depth >= int(validateNum) {
+			inkRemaining, err = c.GetInkContext(ctx)
+			return status.BlockHash, inkRemaining, err
+		}
+		select {
+		case <-time.After(confirmationPollInterval):
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		}
+	}
+}
+
+// Returns the connection to the current miner and its address.
+func (c *MyCanvas) current() (*rpc.Client, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.minerAddr
+}
+
+// Replaces dead, the connection to the current miner, with one to the next
+// miner that answers with the same canvas. Every miner is tried once, the
+// dead one last in case it came back. Does nothing if another call already
+// replaced dead. Miners are dialed without holding c.mu, so calls on a
+// connection that is still alive are not held up.
+func (c *MyCanvas) failover(ctx context.Context, dead *rpc.Client) error {
+	c.mu.Lock()
+	if c.conn != dead {
+		c.mu.Unlock()
+		return nil
+	}
+	deadAddr := c.minerAddr
+	c.mu.Unlock()
+	dead.Close()
+
+	start := 0
+	for i, addr := range c.minerAddrs {
+		if addr == deadAddr {
+			start = i
+		}
+	}
+	for i := 1; i <= len(c.minerAddrs); i++ {
+		addr := c.minerAddrs[(start+i)%len(c.minerAddrs)]
+		conn, setting, err := connectMiner(ctx, addr, c.minerPrivKey)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		if setting != c.CanvSetting {
+			conn.Close()
+			continue
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.conn != dead {
+			// Another call failed over while we were dialing.
+			conn.Close()
+			return nil
+		}
+		c.conn, c.minerAddr = conn, addr
+		return nil
+	}
+	return DisconnectedError(strings.Join(c.minerAddrs, ","))
+}
+
+// Makes an RPC call on conn that is abandoned once ctx is done. The miner's
+// answer is decoded into a value of our own, which net/rpc may still be
+// writing after ctx is done, and copied into reply, a pointer, only if the
+// call succeeds in time. Errors raised by the miner are passed on as their
+// own type; any other failure means the connection to the miner at addr
+// is gone.
+func callOn(ctx context.Context, conn *rpc.Client, addr string, method string, args interface{}, reply interface{}) error {
+	answer := reflect.New(reflect.TypeOf(reply).Elem())
+	call := conn.Go(method, args, answer.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.Error == nil {
+		reflect.ValueOf(reply).Elem().Set(answer.Elem())
+		return nil
+	}
+	if serverErr, ok := call.Error.(rpc.ServerError); ok {
+		return decodeError(serverErr)
+	}
+	return DisconnectedError(addr)
+}
+
+// Reports whether err is the miner's InvalidShapeHashError.
+func isInvalidShapeHash(err error) bool {
+	_, ok := err.(InvalidShapeHashError)
+	return ok
+}
+
+// The hash the miner gives a shape: the md5 of its svg element and the
+// miner's public key, as computed by computeNonceSecretHash in the miner.
+func (c *MyCanvas) shapeHash(shape ShapeSpec) string {
+	svgStr := "<path d=\"" + shape.ShapeSvgString + "\" stroke=\"" + shape.Stroke + "\" fill=\"" + shape.Fill + "\"/>"
+	pub := c.minerPrivKey.PublicKey
+	sum := md5.Sum([]byte(svgStr + pub.X.String() + pub.Y.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+//======================================================================
+//key files
+//======================================================================
+
+// Reads an ecdsa private key from a file. The file may hold a PEM block
+// ("EC PRIVATE KEY" or PKCS#8 "PRIVATE KEY"), as written by blockart-keys,
+// or the hex-encoded x509 key that the tools take on the command line.
+func LoadPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data)
+}
+
+// Parses a private key in any of the formats accepted by LoadPrivateKey.
+func ParsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		keyBytes, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errors.New("key is neither PEM nor hex encoded")
+		}
+		return x509.ParseECPrivateKey(keyBytes)
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("PKCS#8 key is not an ECDSA key")
+		}
+		return ecKey, nil
+	}
+	return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+}
+
+// Writes the key to path as a PEM "EC PRIVATE KEY" block, readable by the
+// owner only. An existing file is only replaced if overwrite is set.
+func SavePrivateKey(path string, key *ecdsa.PrivateKey, overwrite bool) error {
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	fout, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+
+	// OpenFile keeps the mode of a file that already existed.
+	if err := fout.Chmod(0600); err != nil {
+		return err
+	}
+	return pem.Encode(fout, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+}
+
+// Returns the hex-encoded x509 form of the key, as taken on the command
+// line by the miner and art apps.
+func PrivateKeyToHex(key *ecdsa.PrivateKey) (string, error) {
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// Returns the hex SHA-256 of the public key's PKIX encoding, for
+// identifying a key without revealing the private part.
+func PublicKeyFingerprint(pubKey ecdsa.PublicKey) (string, error) {
+	keyBytes, err := x509.MarshalPKIXPublicKey(&pubKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(keyBytes)
+	return hex.EncodeToString(sum[:]), nil
 }
 
 //======================================================================
@@ -446,34 +1607,31 @@ func exitOnError(prefix string, err error) {
 	}
 }
 
+// Returns the id miners give the art node with the given key as the Owner
+// of its shapes, so an art node can tell its own shapes apart. The id is
+// the hex sha256 of the key as the art node sends it with its ops, the hex
+// x509 private key; it is not a fingerprint of the public key.
+func ArtNodeID(privKey ecdsa.PrivateKey) string {
+	sum := sha256.Sum256([]byte(getPrivKeyInStr(privKey)))
+	return hex.EncodeToString(sum[:])
+}
+
 func getPrivKeyInStr(privKey ecdsa.PrivateKey) string {
 	privateKeyBytes, _ := x509.MarshalECPrivateKey(&privKey)
 	privKeyInString := hex.EncodeToString(privateKeyBytes)
 	return privKeyInString
 }
 
-func validSvgCommand(c string) error {
+// The characters of the path commands SvgHelper understands.
+var svgCommandChars = regexp.MustCompile(`^[MmLlHhVvZz0-9 -]*$`)
 
-	for i := 0; i < len(c); i++ {
-		var s = string(c[i : i+1])
-		matched, _ := regexp.MatchString(" |M|m|L|l|H|h|V|v|Z|z|[0-9]+", s)
-		if !matched {
-			return InvalidShapeSvgStringError(c)
-		}
-		// fmt.Println(matched, s)
+func validSvgCommand(c string) error {
+	if onlyWhiteSpace(c) || !svgCommandChars.MatchString(c) {
+		return InvalidShapeSvgStringError(c)
 	}
-
 	return nil
 }
 
 func onlyWhiteSpace(c string) bool {
-
-	for i := 0; i < len(c); i++ {
-		tmp := fmt.Sprint(c[i])
-		if tmp != " " {
-			return false
-		}
-	}
-
-	return true
+	return strings.TrimSpace(c) == ""
 }
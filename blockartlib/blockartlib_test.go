@@ -0,0 +1,145 @@
+package blockartlib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/rpc"
+	"testing"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecBytes, _ := x509.MarshalECPrivateKey(key)
+	pkcs8Bytes, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	formats := map[string][]byte{
+		"hex":    []byte(hex.EncodeToString(ecBytes) + "\n"),
+		"ec pem": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes}),
+		"pkcs8":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes}),
+	}
+	for format, data := range formats {
+		parsed, err := ParsePrivateKey(data)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if parsed.D.Cmp(key.D) != 0 {
+			t.Errorf("%s: parsed a different key", format)
+		}
+	}
+
+	for _, data := range []string{"not a key", "abcd", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"} {
+		if _, err := ParsePrivateKey([]byte(data)); err == nil {
+			t.Errorf("ParsePrivateKey(%q): expected an error", data)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		text string
+		want error
+	}{
+		{`{"Type":"InsufficientInkError","Payload":"5"}`, InsufficientInkError(5)},
+		{`{"Type":"ShapeOverlapError","Payload":"abc"}`, ShapeOverlapError("abc")},
+		{`{"Type":"OutOfBoundsError"}`, OutOfBoundsError{}},
+		{`{"Type":"DisconnectedError","Payload":"miner is shutting down"}`, DisconnectedError("miner is shutting down")},
+		{`{"Type":"InsufficientInkError","Payload":"lots"}`, rpc.ServerError(`{"Type":"InsufficientInkError","Payload":"lots"}`)},
+		{`{"Type":"SomeNewError","Payload":"x"}`, rpc.ServerError(`{"Type":"SomeNewError","Payload":"x"}`)},
+		{"plain text", rpc.ServerError("plain text")},
+	}
+	for _, test := range tests {
+		if got := decodeError(rpc.ServerError(test.text)); got != test.want {
+			t.Errorf("decodeError(%s) = %#v, want %#v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestValidSvgCommand(t *testing.T) {
+	tests := []struct {
+		svg   string
+		valid bool
+	}{
+		{"M 0 0 L 5 5", true},
+		{"M 0 0 h 5 v -5 z", true},
+		{"m 1 1 H 3 V 4 Z", true},
+		{"", false},
+		{"   ", false},
+		{"M 0 0 C 1 1 2 2 3 3", false},
+		{"M 0,0 L 5,5", false},
+		{"M 0 0 L 5 5\n", false},
+	}
+	for _, test := range tests {
+		err := validSvgCommand(test.svg)
+		if (err == nil) != test.valid {
+			t.Errorf("validSvgCommand(%q) = %v, want valid %v", test.svg, err, test.valid)
+		}
+		if err != nil && err != InvalidShapeSvgStringError(test.svg) {
+			t.Errorf("validSvgCommand(%q) = %v, want InvalidShapeSvgStringError", test.svg, err)
+		}
+	}
+}
+
+func TestIntersecting(t *testing.T) {
+	// A horizontal line along y = 0 and the outline of a box from 20,20
+	// to 25,25.
+	line := CanvasShape{ShapeHash: "line", Bounds: Rect{0, 0, 10, 0}}
+	for x := 0; x <= 10; x++ {
+		line.points = append(line.points, [2]int{x, 0})
+	}
+	box := CanvasShape{ShapeHash: "box", Bounds: Rect{20, 20, 25, 25}}
+	for i := 20; i <= 25; i++ {
+		box.points = append(box.points, [2]int{i, 20}, [2]int{i, 25}, [2]int{20, i}, [2]int{25, i})
+	}
+	state := CanvasState{Shapes: []CanvasShape{line, box}}
+
+	tests := []struct {
+		r    Rect
+		want []string
+	}{
+		{Rect{8, 0, 9, 2}, []string{"line"}},
+		{Rect{11, 0, 19, 30}, nil},
+		{Rect{21, 21, 24, 24}, nil}, // inside the box's outline
+		{Rect{22, 24, 30, 30}, []string{"box"}},
+		{Rect{0, 0, 25, 25}, []string{"line", "box"}},
+	}
+	for _, test := range tests {
+		got := state.Intersecting(test.r)
+		if len(got) != len(test.want) {
+			t.Errorf("Intersecting(%v) = %d shapes, want %v", test.r, len(got), test.want)
+			continue
+		}
+		for i, shape := range got {
+			if shape.ShapeHash != test.want[i] {
+				t.Errorf("Intersecting(%v)[%d] = %s, want %s", test.r, i, shape.ShapeHash, test.want[i])
+			}
+		}
+	}
+
+	if got := state.At(25, 22); len(got) != 1 || got[0].ShapeHash != "box" {
+		t.Error("Expected the box at 25,22, got: ", got)
+	}
+	if got := state.At(22, 22); len(got) != 0 {
+		t.Error("Expected nothing at 22,22, got: ", got)
+	}
+}
+
+func TestArtNodeID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The miner hashes the key string the art node sends with its ops.
+	sum := sha256.Sum256([]byte(getPrivKeyInStr(*key)))
+	if id := ArtNodeID(*key); id != hex.EncodeToString(sum[:]) {
+		t.Error("Expected the sha256 of the hex key, got: ", id)
+	}
+}
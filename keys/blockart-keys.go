@@ -0,0 +1,164 @@
+/*
+
+Manages the private keys used by ink miners and art apps in BlockArt.
+
+Keys are P384 ecdsa keys stored as PEM "EC PRIVATE KEY" files that only
+their owner can read. The miner (-key-file) and blockartlib.LoadPrivateKey
+read these files, as well as files holding the older hex encoding.
+
+Usage:
+
+$ go run blockart-keys.go generate -out miner.key [-force]
+    Generates a new key, writes it to the file and prints its fingerprint.
+
+$ go run blockart-keys.go fingerprint -key miner.key
+    Prints the fingerprint of the key's public half.
+
+$ go run blockart-keys.go import -hex <hex key> -out miner.key [-force]
+    Converts a hex-encoded key (as listed in minerKey.txt) into a key file.
+
+$ go run blockart-keys.go hex -key miner.key
+    Prints the key hex-encoded, for tools that take the key as an argument.
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"../blockartlib"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = generate(os.Args[2:])
+	case "fingerprint":
+		err = fingerprint(os.Args[2:])
+	case "import":
+		err = importHex(os.Args[2:])
+	case "hex":
+		err = printHex(os.Args[2:])
+	default:
+		usage()
+	}
+	if err == flag.ErrHelp {
+		return
+	}
+	exitOnError(os.Args[1], err)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: blockart-keys generate|fingerprint|import|hex [flags]")
+	fmt.Fprintln(os.Stderr, "Run blockart-keys <command> -h for the flags of a command.")
+	os.Exit(1)
+}
+
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	out := fs.String("out", "", "Path to write the new key to")
+	force := fs.Bool("force", false, "Overwrite an existing key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := blockartlib.SavePrivateKey(*out, key, *force); err != nil {
+		return err
+	}
+	return printFingerprint(key)
+}
+
+func fingerprint(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ContinueOnError)
+	path := fs.String("key", "", "Path to the key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	key, err := loadKey(*path)
+	if err != nil {
+		return err
+	}
+	return printFingerprint(key)
+}
+
+func importHex(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	hexKey := fs.String("hex", "", "Hex-encoded x509 EC private key")
+	out := fs.String("out", "", "Path to write the key to")
+	force := fs.Bool("force", false, "Overwrite an existing key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *hexKey == "" || *out == "" {
+		return errors.New("-hex and -out are required")
+	}
+
+	key, err := blockartlib.ParsePrivateKey([]byte(*hexKey))
+	if err != nil {
+		return err
+	}
+	if err := blockartlib.SavePrivateKey(*out, key, *force); err != nil {
+		return err
+	}
+	return printFingerprint(key)
+}
+
+func printHex(args []string) error {
+	fs := flag.NewFlagSet("hex", flag.ContinueOnError)
+	path := fs.String("key", "", "Path to the key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	key, err := loadKey(*path)
+	if err != nil {
+		return err
+	}
+	hexKey, err := blockartlib.PrivateKeyToHex(key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hexKey)
+	return nil
+}
+
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("-key is required")
+	}
+	return blockartlib.LoadPrivateKey(path)
+}
+
+func printFingerprint(key *ecdsa.PrivateKey) error {
+	fp, err := blockartlib.PublicKeyFingerprint(key.PublicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fp)
+	return nil
+}
+
+func exitOnError(prefix string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s, err = %s\n", prefix, err.Error())
+		os.Exit(1)
+	}
+}
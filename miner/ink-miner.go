@@ -2,32 +2,79 @@ package main
 
 /*
 	Usage:
-	go run ink-miner.go [server ip:port] [priv-key] [miner listen port] [art-app listen port]
+	go run ink-miner.go -server ip:port -key priv-key -miner-addr :port -art-addr 127.0.0.1:port
+
+	  -art-addr string
+	    	Address to listen on for art nodes (ip:port)
+	  -config string
+	    	Path to an optional JSON config; flags override its values
+	  -data-dir string
+	    	Directory for the miner's persistent state (default miner-data-<miner port>)
+	  -key string
+	    	Hex-encoded x509 EC private key
+	  -key-file string
+	    	Path to a private key file (PEM from blockart-keys, or hex)
+	  -log-level string
+	    	One of debug, info or error (default "info")
+	  -miner-addr string
+	    	Address to listen on for other miners (ip:port or :port)
+	  -mining-threads int
+	    	Number of goroutines searching for nonces (default 1)
+	  -network string
+	    	ID of the server network (canvas) to join (default: the
+	    	server's default network)
+	  -public-addr string
+	    	Address advertised to the server and other miners (default: the
+	    	listen address, or the local IP used to reach the server)
+	  -seeds string
+	    	Comma-separated ip:port list of miners to join through when the
+	    	server is unreachable
+	  -server string
+	    	RPC server ip:port
+
+	The settings handed out by the server are cached in the data dir. If the
+	server cannot be reached at startup, the miner starts from the cached
+	settings, joins the network through the seeds and its address book, and
+	registers once the server is back.
 */
 
 // package ink-miner
 
 import (
+	"container/list"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/rand"
+	"math"
+	"math/big"
+	mathrand "math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"../SvgHelper"
+	"../blockartlib"
 )
 
 var (
@@ -35,20 +82,29 @@ var (
 	_ignored          bool
 	settings          MinerNetSettings
 	myMinerInfo       MinerInfo
-	minersConnectedTo allMinersConnectedTo = allMinersConnectedTo{currentNumNeighbours: 0, all: make([]string, 10)}
+	minersConnectedTo allMinersConnectedTo = allMinersConnectedTo{currentNumNeighbours: 0, all: make([]string, 10), clients: make(map[string]*rpc.Client)}
 	myPrivKey         *ecdsa.PrivateKey
 	serverIPPOrt      string
+	networkID         string // server network (canvas) we mine for
 	miners            []net.Addr
 	localIPPortStr    string
-	localIPPortArr    [2]string
-	artAppListenPort  string
-	globalPubKeyStr   string = ""
+	miningThreads     int           = 1
+	globalPubKeyStr   string        = ""
+	addressBook       AddressBook   = AddressBook{peers: make(map[string]int64)}
+	shutdownCh        chan struct{} = make(chan struct{}) // closed once shutdown starts
+	artListener       net.Listener
+	minerListener     net.Listener
+	artRPCs           rpcTracker
+	errLog            *log.Logger = log.New(os.Stderr, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
+	outLog            *log.Logger = log.New(os.Stderr, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
+	debugLog          *log.Logger = log.New(ioutil.Discard, "[miner] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 )
 
 type allMinersConnectedTo struct {
 	sync.RWMutex
 	currentNumNeighbours int
-	all                  []string // network address of neighbour miners
+	all                  []string               // network address of neighbour miners
+	clients              map[string]*rpc.Client // open connections to neighbour miners
 }
 
 type MinerInfo struct {
@@ -56,6 +112,30 @@ type MinerInfo struct {
 	Key     ecdsa.PublicKey
 }
 
+// An ecdsa signature made with our private key, proving to the server that
+// we own the key we register with.
+type Signature struct {
+	R, S *big.Int
+}
+
+type RegisterArgs struct {
+	MinerInfo MinerInfo
+	NetworkID string    // network to join; "" for the server's default
+	Nonce     string    // from RServer.GetRegistrationNonce
+	Sig       Signature // over registerDigest(MinerInfo, NetworkID, Nonce)
+}
+
+type GetNodesArgs struct {
+	Signed    SignedKey // purpose "getnodes"
+	NetworkID string
+}
+
+type SignedKey struct {
+	Key       ecdsa.PublicKey
+	Timestamp int64     // unix nanoseconds
+	Sig       Signature // over timestampDigest(purpose, Key, Timestamp)
+}
+
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
@@ -135,11 +215,19 @@ type MinerRPCs interface {
 	Connect(privatekey string, reply *ValidMiner) error
 	GetInk(privatekey string, reply *uint32) error
 	AddShape(args AddShapeStruct, reply *AddShapeReply) error
+	SubmitShape(args AddShapeStruct, reply *AddShapeReply) error
+	AddShapes(args AddShapesArgs, reply *AddShapesReply) error
+	GetConfirmations(shapeHash string, status *OpStatus) error
+	GetCanvasState(blockHash string, shapes *[]CanvasShape) error
+	GetBlock(blockHash string, summary *BlockSummary) error
+	GetChainTip(args int, tip *string) error
+	GetShapeInfo(shapeHash string, info *ShapeInfo) error
 	GetSvgString(shapeHash string, svgString *string) error
 	DeleteShape(args DelShapeArgs, inkRemaining *uint32) error
 	GetShapes(blockHash string, shapeHashes *[]string) error
 	GetGenesisBlock(args int, blockHash *string) error
 	GetChildren(blockHash string, blockHashes *[]string) error
+	WatchChain(args WatchArgs, reply *WatchReply) error
 	CloseCanvas(args int, reply *CloseCanvReply) error
 }
 
@@ -154,6 +242,7 @@ type Miner2MinerRPCs interface {
 	PrintText(textToPrint string, reply *string) error
 	EstablishReverseRPC(addr string, reply *string) error
 	SendBlockChain(bc []Block, reply *string) error
+	GetPeers(args GetPeersArgs, reply *[]PeerRecord) error
 }
 
 // Interface between art app and ink miner
@@ -191,6 +280,26 @@ type AddShapeReply struct {
 	InkRemaining uint32
 }
 
+// One shape of an AddShapes batch.
+type ShapeSpec struct {
+	ShapeType      ShapeType
+	ShapeSvgString string
+	Fill           string
+	Stroke         string
+}
+
+type AddShapesArgs struct {
+	ValidateNum uint8
+	Shapes      []ShapeSpec
+	ArtNodePK   string
+}
+
+type AddShapesReply struct {
+	ShapeHashes  []string // in the order of AddShapesArgs.Shapes
+	BlockHash    string
+	InkRemaining uint32
+}
+
 var myKeyPairInString string
 
 type DelShapeArgs struct {
@@ -213,7 +322,20 @@ func exitOnError(prefix string, err error) {
 }
 
 var ExpectedError = errors.New("Expected error, none found")
-var UnknownKeyError = errors.New("Server does not know given miner key")
+var UnknownKeyError = errors.New("BlockArt server: unknown key")
+
+// net/rpc only carries the message of a server error, so server errors are
+// recognised by their text.
+func isServerError(err error, serverErr error) bool {
+	return err != nil && err.Error() == serverErr.Error()
+}
+
+// Contains the reason the art node could not be served.
+type DisconnectedError string
+
+func (e DisconnectedError) Error() string {
+	return fmt.Sprintf("BlockArt: cannot connect to [%s]", string(e))
+}
 
 type InvalidMinerPKError string
 
@@ -245,55 +367,312 @@ func (e InsufficientInkError) Error() string {
 	return fmt.Sprintf("BlockArt: Not enough ink to addShape [%d]", uint32(e))
 }
 
-func main() {
-	// Read in command line args
-	// args[0] is server:port, args[1] is private key, args[2] is miner port, args[3] is art-app port
-	args := os.Args[1:]
-	ipPort := args[0]
-	myKeyPairInString = args[1]
-	port := args[2]
-	artAppListenPort = args[3]
+// An error as sent to art nodes. net/rpc only carries the text of an
+// error, so art-node RPCs send this JSON-encoded instead, and blockartlib
+// rebuilds the typed error from Type and Payload.
+type ErrorEnvelope struct {
+	Type    string // name of the error type, the same in blockartlib
+	Payload string // the error's value: a hash, svg string, key or ink amount
+	Message string
+}
+
+func (e ErrorEnvelope) Error() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// Puts the error returned by an art-node RPC in an ErrorEnvelope. Errors
+// blockartlib has no type for are left as they are.
+func envelopeError(err *error) {
+	var env ErrorEnvelope
+	switch e := (*err).(type) {
+	case DisconnectedError:
+		env = ErrorEnvelope{Type: "DisconnectedError", Payload: string(e)}
+	case InvalidMinerPKError:
+		env = ErrorEnvelope{Type: "InvalidMinerPKError", Payload: string(e)}
+	case InvalidShapeHashError:
+		env = ErrorEnvelope{Type: "InvalidShapeHashError", Payload: string(e)}
+	case InvalidBlockHashError:
+		env = ErrorEnvelope{Type: "InvalidBlockHashError", Payload: string(e)}
+	case ShapeOwnerError:
+		env = ErrorEnvelope{Type: "ShapeOwnerError", Payload: string(e)}
+	case SvgHelper.ShapeOwnerError:
+		env = ErrorEnvelope{Type: "ShapeOwnerError", Payload: string(e)}
+	case InsufficientInkError:
+		env = ErrorEnvelope{Type: "InsufficientInkError", Payload: strconv.FormatUint(uint64(e), 10)}
+	case SvgHelper.InsufficientInkError:
+		env = ErrorEnvelope{Type: "InsufficientInkError", Payload: strconv.FormatUint(uint64(e), 10)}
+	case SvgHelper.OutOfBoundsError:
+		env = ErrorEnvelope{Type: "OutOfBoundsError"}
+	case SvgHelper.ShapeOverlapError:
+		env = ErrorEnvelope{Type: "ShapeOverlapError", Payload: string(e)}
+	case SvgHelper.InvalidShapeSvgStringError:
+		env = ErrorEnvelope{Type: "InvalidShapeSvgStringError", Payload: string(e)}
+	case SvgHelper.ShapeSvgStringTooLongError:
+		env = ErrorEnvelope{Type: "ShapeSvgStringTooLongError", Payload: string(e)}
+	default:
+		return
+	}
+	env.Message = (*err).Error()
+	*err = env
+}
+
+/*********************************
+Configuration
+*********************************/
+
+// Miner configuration. Read from the optional JSON file given with -config;
+// any flag set on the command line takes precedence over the file.
+type MinerConfig struct {
+	ServerAddr    string `json:"server-addr"`
+	MinerAddr     string `json:"miner-addr"`
+	PublicAddr    string `json:"public-addr"`
+	ArtAddr       string `json:"art-addr"`
+	Network       string `json:"network"`
+	PrivKey       string `json:"priv-key"`
+	KeyFile       string `json:"key-file"`
+	DataDir       string `json:"data-dir"`
+	LogLevel      string `json:"log-level"`
+	MiningThreads int    `json:"mining-threads"`
+
+	// Miners to connect to when the server cannot hand out any.
+	Seeds []string `json:"seeds"`
+}
+
+func loadMinerConfig(args []string) (MinerConfig, error) {
+	config := MinerConfig{LogLevel: "info", MiningThreads: 1}
+	var flagConfig MinerConfig
+
+	fs := flag.NewFlagSet("ink-miner", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Path to an optional JSON config; flags override its values")
+	fs.StringVar(&flagConfig.ServerAddr, "server", "", "RPC server ip:port")
+	fs.StringVar(&flagConfig.MinerAddr, "miner-addr", "", "Address to listen on for other miners (ip:port or :port)")
+	fs.StringVar(&flagConfig.PublicAddr, "public-addr", "", "Address advertised to the server and other miners (default: the listen address, or the local IP used to reach the server)")
+	fs.StringVar(&flagConfig.ArtAddr, "art-addr", "", "Address to listen on for art nodes (ip:port)")
+	fs.StringVar(&flagConfig.Network, "network", "", "ID of the server network (canvas) to join (default: the server's default network)")
+	fs.StringVar(&flagConfig.PrivKey, "key", "", "Hex-encoded x509 EC private key")
+	fs.StringVar(&flagConfig.KeyFile, "key-file", "", "Path to a private key file (PEM from blockart-keys, or hex)")
+	fs.StringVar(&flagConfig.DataDir, "data-dir", "", "Directory for the miner's persistent state (default miner-data-<miner port>)")
+	fs.StringVar(&flagConfig.LogLevel, "log-level", "info", "One of debug, info or error")
+	fs.IntVar(&flagConfig.MiningThreads, "mining-threads", 1, "Number of goroutines searching for nonces")
+	seeds := fs.String("seeds", "", "Comma-separated ip:port list of miners to join through when the server is unreachable")
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	if fs.NArg() > 0 {
+		return config, fmt.Errorf("unexpected arguments %v (the miner takes named flags only, see -h)", fs.Args())
+	}
+
+	if *configPath != "" {
+		buffer, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return config, err
+		}
+		if err := json.Unmarshal(buffer, &config); err != nil {
+			return config, fmt.Errorf("parse %s: %s", *configPath, err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			config.ServerAddr = flagConfig.ServerAddr
+		case "miner-addr":
+			config.MinerAddr = flagConfig.MinerAddr
+		case "public-addr":
+			config.PublicAddr = flagConfig.PublicAddr
+		case "art-addr":
+			config.ArtAddr = flagConfig.ArtAddr
+		case "network":
+			config.Network = flagConfig.Network
+		case "key":
+			config.PrivKey = flagConfig.PrivKey
+		case "key-file":
+			config.KeyFile = flagConfig.KeyFile
+		case "data-dir":
+			config.DataDir = flagConfig.DataDir
+		case "log-level":
+			config.LogLevel = flagConfig.LogLevel
+		case "mining-threads":
+			config.MiningThreads = flagConfig.MiningThreads
+		case "seeds":
+			config.Seeds = nil
+			for _, seed := range strings.Split(*seeds, ",") {
+				if seed = strings.TrimSpace(seed); seed != "" {
+					config.Seeds = append(config.Seeds, seed)
+				}
+			}
+		}
+	})
+
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+	if config.DataDir == "" {
+		_, port, _ := net.SplitHostPort(config.MinerAddr)
+		config.DataDir = "miner-data-" + port
+	}
+	return config, nil
+}
+
+func (c MinerConfig) validate() error {
+	if err := validateAddr("server", c.ServerAddr, true); err != nil {
+		return err
+	}
+	if err := validateAddr("miner-addr", c.MinerAddr, false); err != nil {
+		return err
+	}
+	if c.PublicAddr != "" {
+		if err := validateAddr("public-addr", c.PublicAddr, true); err != nil {
+			return err
+		}
+	}
+	if err := validateAddr("art-addr", c.ArtAddr, false); err != nil {
+		return err
+	}
+	if c.PrivKey == "" && c.KeyFile == "" {
+		return errors.New("one of -key or -key-file is required")
+	}
+	if c.PrivKey != "" && c.KeyFile != "" {
+		return errors.New("-key and -key-file cannot both be given")
+	}
+	switch c.LogLevel {
+	case "debug", "info", "error":
+	default:
+		return fmt.Errorf("-log-level must be debug, info or error, got %q", c.LogLevel)
+	}
+	if c.MiningThreads < 1 {
+		return fmt.Errorf("-mining-threads must be at least 1, got %d", c.MiningThreads)
+	}
+	for _, seed := range c.Seeds {
+		if err := validateAddr("seeds", seed, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that addr is a host:port pair with a valid port. The host may only
+// be left out if needHost is false.
+func validateAddr(name string, addr string, needHost bool) error {
+	if addr == "" {
+		return fmt.Errorf("-%s is required", name)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("-%s: %s", name, err)
+	}
+	if needHost && host == "" {
+		return fmt.Errorf("-%s: missing host in %q", name, addr)
+	}
 	portInt, err := strconv.Atoi(port)
+	if err != nil || portInt < 1 || portInt > 65535 {
+		return fmt.Errorf("-%s: invalid port %q", name, port)
+	}
+	return nil
+}
+
+func setLogLevel(level string) {
+	switch level {
+	case "debug":
+		debugLog.SetOutput(os.Stderr)
+	case "error":
+		outLog.SetOutput(ioutil.Discard)
+	}
+}
+
+func loadMinerKey(config MinerConfig) (*ecdsa.PrivateKey, error) {
+	if config.KeyFile != "" {
+		return blockartlib.LoadPrivateKey(config.KeyFile)
+	}
+	key, err := blockartlib.ParsePrivateKey([]byte(config.PrivKey))
+	if err != nil {
+		return nil, fmt.Errorf("-key: %s", err)
+	}
+	return key, nil
+}
+
+// Returns the address other miners should use to reach us. If neither
+// -public-addr nor a listen host is given, the local IP used to reach the
+// server (or else one of the seeds) is paired with the listen port.
+func advertisedAddr(config MinerConfig) (string, error) {
+	if config.PublicAddr != "" {
+		return config.PublicAddr, nil
+	}
+	host, port, _ := net.SplitHostPort(config.MinerAddr)
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return config.MinerAddr, nil
+	}
+
+	var conn net.Conn
+	var err error
+	for _, addr := range append([]string{config.ServerAddr}, config.Seeds...) {
+		if conn, err = net.DialTimeout("tcp", addr, 5*time.Second); err == nil {
+			break
+		}
+	}
 	if err != nil {
-		exitOnError("Port is invalid", err)
+		return "", fmt.Errorf("cannot reach server or seeds to find our IP, set -public-addr: %s", err)
+	}
+	defer conn.Close()
+	localHost, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(localHost, port), nil
+}
+
+func main() {
+	config, err := loadMinerConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	exitOnError("invalid configuration", err)
+	setLogLevel(config.LogLevel)
+	miningThreads = config.MiningThreads
+	networkID = config.Network
+	ipPort := config.ServerAddr
+
+	myPrivKey, err = loadMinerKey(config)
+	exitOnError("load private key", err)
+	myKeyPairInString = getPrivKeyInStr(*myPrivKey)
+
+	localIPPortStr, err = advertisedAddr(config)
+	exitOnError("work out miner address", err)
+	outLog.Println("Miner address is", localIPPortStr)
+
+	err = os.MkdirAll(config.DataDir, 0700)
+	exitOnError("create data dir", err)
+	addressBook.path = filepath.Join(config.DataDir, "peers.json")
+	if err := addressBook.load(); err != nil {
+		errLog.Println("Could not load address book, starting with an empty one:", err)
+	}
+	for _, seed := range config.Seeds {
+		if seed != localIPPortStr {
+			addressBook.seen(seed)
+		}
 	}
+	settingsCachePath = filepath.Join(config.DataDir, "settings.json")
 
-	conn, _ := net.Dial("tcp", ipPort)
-	localIPPortArr := strings.Split(conn.LocalAddr().String(), ":")
-	fmt.Println("my address")
-	fmt.Println(localIPPortArr)
-	conn.Close()
-	localIPPortStr = fmt.Sprintf("%s:%d", localIPPortArr[0], portInt)
-	fmt.Println(localIPPortStr)
 	// Register with the Server and get settings
 	addr, err := net.ResolveTCPAddr("tcp", localIPPortStr)
-
 	exitOnError("resolve addr", err)
-	keyAsBytes, _ := hex.DecodeString(myKeyPairInString)
-	myPrivKeyLocal, _ := x509.ParseECPrivateKey(keyAsBytes)
-	myPrivKey = myPrivKeyLocal
 
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
 
-	// Establish RPC connection to server
-	cRPC, err := rpc.Dial("tcp", ipPort)
-	defer cRPC.Close()
-	if err != nil {
-		fmt.Println("Error dialing to server ", err.Error)
-	}
-	fmt.Println("Miner address is ====== " + addr.String())
 	myMinerInfo = MinerInfo{Address: addr, Key: myPrivKey.PublicKey}
-	err = cRPC.Call("RServer.Register", myMinerInfo, &settings)
+	settings, err = registerOrLoadSettings(ipPort, myMinerInfo)
 	exitOnError(fmt.Sprintf("client registration for %s", myMinerInfo.Address), err)
-	listenToArtnode(ipPort)
+	listenToArtnode(config.ArtAddr)
 
 	go sendHeartBeats(ipPort, myMinerInfo, settings.HeartBeat)
-	go listenForIncomingConnections(portInt)
+	go listenForIncomingConnections(config.MinerAddr)
 
 	go monitorNumConnections(ipPort)
+	go handleSignals()
 
-	for {
+	for !isShuttingDown() {
 		sleep_time := 500 * time.Millisecond
 		time.Sleep(sleep_time)
 
@@ -305,7 +684,7 @@ func main() {
 		}
 
 		mineNoOpBlocks(globalPubKeyStr)
-		randSleepTime := time.Duration(rand.Intn(2000)) * time.Millisecond
+		randSleepTime := time.Duration(mathrand.Intn(2000)) * time.Millisecond
 		time.Sleep(randSleepTime)
 		//fmt.Printf("Mined a block. Blockchain is now %d\n", len(blockChain))
 
@@ -313,6 +692,8 @@ func main() {
 		// fmt.Printf("Last blk index: %d\n", blockChain[lastOne].Index)
 		//fmt.Printf("globalPubKeyStr: %s\n", globalPubKeyStr)
 	}
+
+	shutdown(ipPort)
 }
 
 // This function mines NoOpBlocks idly
@@ -360,7 +741,7 @@ func generateNoOpBlock(minerPubKey string) Block {
 		// fmt.Println("incrementing ink")
 		// fmt.Println(myInkAccount)
 		myInkAccount.InkMined = myInkAccount.InkMined + settings.InkPerNoOpBlock
-		fmt.Printf("reward: %d\n", settings.InkPerNoOpBlock)
+		debugLog.Printf("reward: %d\n", settings.InkPerNoOpBlock)
 		myInkAccount.InkRemain = myInkAccount.InkRemain + settings.InkPerNoOpBlock
 		oldMinerInks[minerPubKey] = myInkAccount
 		// str := minerPubKey
@@ -424,6 +805,9 @@ func blkToString(b Block) string {
 // [prev-hash, op, op-signature, pub-key, nonce, other data structures]
 func calculateHash(b Block, powDifficulty uint8) (hash, nonce string) {
 	blockString := blkToString(b)
+	if miningThreads > 1 {
+		return calculateHashParallel(blockString, powDifficulty, miningThreads)
+	}
 
 	j := int64(0)
 	for {
@@ -438,6 +822,46 @@ func calculateHash(b Block, powDifficulty uint8) (hash, nonce string) {
 	return hash, nonce
 }
 
+// Number of nonces the mining threads share out per round.
+const nonceRoundSize = 4096
+
+/*
+Same search as calculateHash, split across threads goroutines. Block hashes
+are recomputed with calculateHash all over the miner, so this must return
+the smallest valid nonce just like the sequential search: nonces are
+searched in rounds and the smallest hit of the first round with any hit
+wins.
+*/
+func calculateHashParallel(blockString string, powDifficulty uint8, threads int) (hash, nonce string) {
+	for start := int64(0); ; start += nonceRoundSize {
+		best := int64(-1)
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for t := 0; t < threads; t++ {
+			wg.Add(1)
+			go func(first int64) {
+				defer wg.Done()
+				for j := first; j < start+nonceRoundSize; j += int64(threads) {
+					if hasNZeros(computeNonceSecretHash(blockString, strconv.FormatInt(j, 10)), powDifficulty) {
+						mutex.Lock()
+						if best < 0 || j < best {
+							best = j
+						}
+						mutex.Unlock()
+						return
+					}
+				}
+			}(start + int64(t))
+		}
+		wg.Wait()
+
+		if best >= 0 {
+			nonce = strconv.FormatInt(best, 10)
+			return computeNonceSecretHash(blockString, nonce), nonce
+		}
+	}
+}
+
 // [prev-hash, op, op-signature, pub-key, nonce, other data structures]
 func convertOpToString(ops []Operation) string {
 	opsString := ""
@@ -474,22 +898,36 @@ func monitorNumConnections(ipPort string) {
 	for {
 		sleep_time := 10000 * time.Millisecond
 		time.Sleep(sleep_time)
+		if isShuttingDown() {
+			return
+		}
 
-		fmt.Printf("Blockchain length is now %d\n", len(blockChain))
+		debugLog.Printf("Blockchain length is now %d\n", len(blockChain))
 		lastOne := len(blockChain) - 1
 		inkMinedRightNow := blockChain[lastOne].MinerInks[globalPubKeyStr].InkMined
 		inkRemainingRightNow := blockChain[lastOne].MinerInks[globalPubKeyStr].InkRemain
 
-		fmt.Printf("My ink mined is %d remaining is: %d\n", inkMinedRightNow, inkRemainingRightNow)
+		debugLog.Printf("My ink mined is %d remaining is: %d\n", inkMinedRightNow, inkRemainingRightNow)
 
 		var neighbours []net.Addr
 
-		helperGetNodes(ipPort, myMinerInfo, &neighbours)
+		_, err := helperGetNodes(ipPort, myMinerInfo, &neighbours)
+		if err != nil {
+			// The server is unreachable, so rebuild the mesh from the
+			// peers we (or our neighbours) have recently talked to.
+			errLog.Println("GetNodes failed, falling back to the address book:", err)
+			neighbours = peersFromAddressBook(int(settings.MinNumMinerConnections))
+		}
 		if len(neighbours) > 0 {
-			fmt.Println("Below is the neighbours the server wants us to connect to.")
-			fmt.Println(neighbours)
+			debugLog.Println("Below is the neighbours the server wants us to connect to.")
+			debugLog.Println(neighbours)
 			connectToMiners(neighbours)
 		}
+
+		addressBook.prune()
+		if err := addressBook.save(); err != nil {
+			errLog.Println("Could not save address book:", err)
+		}
 	}
 }
 
@@ -506,54 +944,380 @@ Miner-Server Communication
 ****************************/
 
 /*
-Send heartbeats to server at regular intervals to maintain RPC connection
+Send heartbeats to server at regular intervals to maintain RPC connection.
+A failed heartbeat is retried on a fresh connection with exponential
+backoff, and if the server has forgotten our key we register again. The
+miner keeps mining and serving art nodes while the server is unreachable.
 */
 func sendHeartBeats(ipPort string, miner MinerInfo, heartBeatInterval uint32) {
+	hbInMilliSec := time.Duration(heartBeatInterval) * time.Millisecond
+	timeToSleep := hbInMilliSec / 20
+	maxBackoff := hbInMilliSec / 2
+	backoff := timeToSleep
+
+	var cRPC *rpc.Client
+	for !isShuttingDown() {
+		if cRPC == nil {
+			c, err := rpc.Dial("tcp", ipPort)
+			if err != nil {
+				errLog.Printf("Cannot reach server, retrying in %s: %s\n", backoff, err)
+				backoff = sleepBackoff(backoff, maxBackoff)
+				continue
+			}
+			cRPC = c
+		}
 
-	cRPC, err := rpc.Dial("tcp", ipPort)
-	defer cRPC.Close()
+		err := cRPC.Call("RServer.HeartBeat", signKey("heartbeat"), &_ignored)
+		if isServerError(err, UnknownKeyError) {
+			outLog.Println("Server does not know our key anymore, registering again")
+			err = reRegister(cRPC, miner)
+			if err == nil {
+				// The server may have handed out a new interval.
+				hbInMilliSec = time.Duration(settings.HeartBeat) * time.Millisecond
+				timeToSleep = hbInMilliSec / 20
+				maxBackoff = hbInMilliSec / 2
+			}
+		}
+		if err != nil {
+			errLog.Printf("Heartbeat failed, retrying in %s: %s\n", backoff, err)
+			cRPC.Close()
+			cRPC = nil
+			backoff = sleepBackoff(backoff, maxBackoff)
+			continue
+		}
+		// The server's config may have been reloaded with a new interval.
+		// Older servers do not have HeartBeatInterval.
+		var interval uint32
+		err = cRPC.Call("RServer.HeartBeatInterval", networkID, &interval)
+		if err == nil && interval != 0 && interval != settings.HeartBeat {
+			outLog.Printf("Server changed the heartbeat interval to %dms\n", interval)
+			settings.HeartBeat = interval
+			hbInMilliSec = time.Duration(interval) * time.Millisecond
+			timeToSleep = hbInMilliSec / 20
+			maxBackoff = hbInMilliSec / 2
+		}
+
+		// Older servers do not take reports, so a failed report is not
+		// treated as a failed heartbeat.
+		if err := reportNeighbours(cRPC, miner); err != nil {
+			debugLog.Println("ReportNeighbours failed:", err)
+		}
+
+		backoff = timeToSleep
+		time.Sleep(timeToSleep)
+	}
+
+	if cRPC != nil {
+		cRPC.Close()
+	}
+}
+
+type NeighbourReport struct {
+	Signed      SignedKey // purpose "neighbours"
+	Neighbours  []string  // addresses of the miners we are connected to
+	ChainTip    string    // hash of the last block in our chain
+	ChainLength int
+}
+
+// Tells the server who we are connected to and where our chain is at.
+func reportNeighbours(cRPC *rpc.Client, miner MinerInfo) error {
+	tip, length := chainTip()
+	report := NeighbourReport{
+		Signed:      signKey("neighbours"),
+		Neighbours:  currentNeighbours(),
+		ChainTip:    tip,
+		ChainLength: length,
+	}
+	return cRPC.Call("RServer.ReportNeighbours", report, &_ignored)
+}
+
+func currentNeighbours() []string {
+	minersConnectedTo.RLock()
+	defer minersConnectedTo.RUnlock()
+	neighbours := make([]string, 0, len(minersConnectedTo.clients))
+	for addr := range minersConnectedTo.clients {
+		neighbours = append(neighbours, addr)
+	}
+	return neighbours
+}
+
+// Returns the hash of the last block in our chain and the chain's length.
+func chainTip() (string, int) {
+	chain := blockChain
+	if len(chain) == 0 {
+		return settings.GenesisBlockHash, 0
+	}
+	return blockHash(chain[len(chain)-1]), len(chain)
+}
+
+// Hashes are found by redoing the proof of work, so the ones used last are
+// remembered, by the md5 of the block contents.
+const blockHashCacheSize = 1024
+
+var blockHashCache = struct {
+	sync.Mutex
+	hashes map[string]*list.Element // of blockHashEntry
+	order  *list.List               // most recently used first
+}{hashes: make(map[string]*list.Element), order: list.New()}
+
+type blockHashEntry struct {
+	key  string
+	hash string
+}
+
+func blockHash(b Block) string {
+	sum := md5.Sum([]byte(strconv.FormatBool(b.NoOpBlock) + ":" + blkToString(b)))
+	key := string(sum[:])
+	blockHashCache.Lock()
+	if e, ok := blockHashCache.hashes[key]; ok {
+		blockHashCache.order.MoveToFront(e)
+		blockHashCache.Unlock()
+		return e.Value.(blockHashEntry).hash
+	}
+	blockHashCache.Unlock()
+
+	var difficulty uint8
+	if b.NoOpBlock {
+		difficulty = settings.PoWDifficultyNoOpBlock
+	} else {
+		difficulty = settings.PoWDifficultyOpBlock
+	}
+	hash, _ := calculateHash(b, difficulty)
+	blockHashCache.Lock()
+	if _, ok := blockHashCache.hashes[key]; !ok {
+		blockHashCache.hashes[key] = blockHashCache.order.PushFront(blockHashEntry{key, hash})
+		if blockHashCache.order.Len() > blockHashCacheSize {
+			oldest := blockHashCache.order.Remove(blockHashCache.order.Back()).(blockHashEntry)
+			delete(blockHashCache.hashes, oldest.key)
+		}
+	}
+	blockHashCache.Unlock()
+	return hash
+}
+
+// The hashes of the blocks of the chain last hashed by chainHashes, shared
+// by every WatchChain call so that polling doesn't hash the chain again
+// until it changes.
+var chainHashCache struct {
+	sync.Mutex
+	first  *Block // the first block of the chain hashed
+	hashes []string
+}
+
+// Returns the hashes of the blocks of chain, in order. The returned slice
+// is shared and must not be changed. Our chain is only ever appended to or
+// replaced by a new one, so the blocks in the backing array hashed last are
+// still the same and only the blocks after them need hashing.
+func chainHashes(chain []Block) []string {
+	if len(chain) == 0 {
+		return nil
+	}
+	chainHashCache.Lock()
+	defer chainHashCache.Unlock()
+	hashes := chainHashCache.hashes
+	if chainHashCache.first != &chain[0] {
+		hashes = nil
+	}
+	if len(hashes) >= len(chain) {
+		return hashes[:len(chain):len(chain)]
+	}
+	hashes = append(make([]string, 0, len(chain)), hashes...)
+	for _, b := range chain[len(hashes):] {
+		hashes = append(hashes, blockHash(b))
+	}
+	chainHashCache.first, chainHashCache.hashes = &chain[0], hashes
+	return hashes
+}
+
+// Sleeps for backoff and returns the next, doubled, backoff capped at max.
+func sleepBackoff(backoff, max time.Duration) time.Duration {
+	time.Sleep(backoff)
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+/*
+Registers with the server, proving we own the key by signing a nonce the
+server hands out.
+*/
+func register(cRPC *rpc.Client, miner MinerInfo) (MinerNetSettings, error) {
+	var nonce string
+	var newSettings MinerNetSettings
+	if err := cRPC.Call("RServer.GetRegistrationNonce", false, &nonce); err != nil {
+		return newSettings, err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, myPrivKey, registerDigest(miner, networkID, nonce))
 	if err != nil {
-		fmt.Println(err.Error)
+		return newSettings, err
 	}
+	args := RegisterArgs{MinerInfo: miner, NetworkID: networkID, Nonce: nonce, Sig: Signature{r, s}}
+	err = cRPC.Call("RServer.Register", args, &newSettings)
+	return newSettings, err
+}
 
-	hbInMilliSec := time.Duration(heartBeatInterval) * time.Millisecond
-	timeToSleep := hbInMilliSec / 20
-	fmt.Println(timeToSleep)
+// Timestamp of the last SignedKey we made; the server wants them strictly
+// increasing.
+var lastSignedTimestamp int64
+
+// Signs the current time for the server call named by purpose.
+func signKey(purpose string) SignedKey {
+	timestamp := time.Now().UnixNano()
 	for {
-		time.Sleep(timeToSleep)
-		err = cRPC.Call("RServer.HeartBeat", miner.Key, &_ignored)
-		if err != nil {
-			exitOnError("late heartbeat", ExpectedError)
+		last := atomic.LoadInt64(&lastSignedTimestamp)
+		if timestamp <= last {
+			timestamp = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastSignedTimestamp, last, timestamp) {
+			break
 		}
 	}
+	sk := SignedKey{Key: myPrivKey.PublicKey, Timestamp: timestamp}
+	r, s, err := ecdsa.Sign(rand.Reader, myPrivKey, timestampDigest(purpose, sk.Key, timestamp))
+	if err != nil {
+		errLog.Println("Could not sign", purpose, err)
+		return sk
+	}
+	sk.Sig = Signature{r, s}
+	return sk
+}
+
+// Must match the server's registerDigest.
+func registerDigest(m MinerInfo, networkID string, nonce string) []byte {
+	sum := sha256.Sum256([]byte("register:" + nonce + ":" + networkID + ":" + m.Address.Network() + ":" + m.Address.String() + ":" + string(elliptic.Marshal(m.Key.Curve, m.Key.X, m.Key.Y))))
+	return sum[:]
+}
+
+// Must match the server's timestampDigest.
+func timestampDigest(purpose string, key ecdsa.PublicKey, timestamp int64) []byte {
+	sum := sha256.Sum256([]byte(purpose + ":" + strconv.FormatInt(timestamp, 10) + ":" + string(elliptic.Marshal(key.Curve, key.X, key.Y))))
+	return sum[:]
+}
+
+/*
+Registers with the server again after it has dropped our registration. Of
+the settings handed back we only pick up the heartbeat interval and the
+minimum number of connections, which the server may change at runtime; the
+rest are checked against the ones we are mining with, since changing them
+mid-chain would fork us off the network.
+*/
+func reRegister(cRPC *rpc.Client, miner MinerInfo) error {
+	newSettings, err := register(cRPC, miner)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "BlockArt server: key already registered") {
+			return nil
+		}
+		return err
+	}
+	if newSettings.GenesisBlockHash != settings.GenesisBlockHash {
+		errLog.Println("Warning: server now reports a different genesis block, keeping our settings")
+	} else {
+		settings.HeartBeat = newSettings.HeartBeat
+		settings.MinNumMinerConnections = newSettings.MinNumMinerConnections
+		if err := saveCachedSettings(settings); err != nil {
+			errLog.Println("Could not cache settings:", err)
+		}
+	}
+	outLog.Println("Registered with the server again")
+	return nil
+}
+
+/*
+Registers with the server and caches the settings it hands out. If the
+server cannot be reached, the settings cached by a previous run are used
+instead, so that we can join the network through the seeds and the address
+book; sendHeartBeats registers once the server is back. Errors returned by
+the server itself are not papered over.
+*/
+func registerOrLoadSettings(ipPort string, miner MinerInfo) (MinerNetSettings, error) {
+	conn, err := net.DialTimeout("tcp", ipPort, 5*time.Second)
+	if err == nil {
+		cRPC := rpc.NewClient(conn)
+		defer cRPC.Close()
+
+		var newSettings MinerNetSettings
+		newSettings, err = register(cRPC, miner)
+		if err == nil {
+			if err := saveCachedSettings(newSettings); err != nil {
+				errLog.Println("Could not cache settings:", err)
+			}
+			return newSettings, nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			return newSettings, err
+		}
+	}
+
+	errLog.Println("Cannot reach the server:", err)
+	cached, cacheErr := loadCachedSettings()
+	if cacheErr != nil {
+		return cached, fmt.Errorf("server unreachable (%s) and no usable cached settings (%s)", err, cacheErr)
+	}
+	outLog.Println("Starting from cached settings, will register once the server is back")
+	return cached, nil
+}
+
+// Settings handed out by the server, as cached in the data dir.
+type cachedSettings struct {
+	NetworkID string           `json:"network-id"`
+	Settings  MinerNetSettings `json:"settings"`
+}
+
+// Where the server's settings are cached; set in main.
+var settingsCachePath string
+
+func saveCachedSettings(s MinerNetSettings) error {
+	buffer, err := json.Marshal(cachedSettings{networkID, s})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(settingsCachePath, buffer, 0644)
+}
+
+func loadCachedSettings() (MinerNetSettings, error) {
+	var cached cachedSettings
+	buffer, err := ioutil.ReadFile(settingsCachePath)
+	if err != nil {
+		return cached.Settings, err
+	}
+	if err := json.Unmarshal(buffer, &cached); err != nil {
+		return cached.Settings, fmt.Errorf("parse %s: %s", settingsCachePath, err)
+	}
+	if cached.NetworkID != networkID {
+		return cached.Settings, fmt.Errorf("%s is for network %q, not %q", settingsCachePath, cached.NetworkID, networkID)
+	}
+	return cached.Settings, nil
 }
 
 /*
 A wrapper on the GetNodes RPC call. It invokes a GetNodes RPC call only if the
 current number of connections is less than the minimum.
 
-@returns: true if addresses were obtained and false otherwise
+@returns: true if addresses were obtained and false otherwise, and an error if
+the server could not be reached or refused the call
 */
-func helperGetNodes(ipPort string, miner MinerInfo, addrSet *[]net.Addr) bool {
+func helperGetNodes(ipPort string, miner MinerInfo, addrSet *[]net.Addr) (bool, error) {
 	minersConnectedTo.Lock()
 	defer minersConnectedTo.Unlock()
 	if minersConnectedTo.currentNumNeighbours < int(settings.MinNumMinerConnections) {
 		//fmt.Println("Inside helper get node, ready to make RPC call")
 		cRPC, err := rpc.Dial("tcp", ipPort)
-		defer cRPC.Close()
 		if err != nil {
-			fmt.Println(err.Error)
+			return false, err
 		}
+		defer cRPC.Close()
 
-		err = cRPC.Call("RServer.GetNodes", miner.Key, addrSet)
+		err = cRPC.Call("RServer.GetNodes", GetNodesArgs{signKey("getnodes"), networkID}, addrSet)
 		if err != nil {
-			exitOnError(miner.Address.String(), err)
+			return false, err
 		}
 
-		return true
+		return true, nil
 	}
 
-	return false
+	return false, nil
 }
 
 func connectToMiners(addrSet []net.Addr) {
@@ -569,76 +1333,385 @@ func connectToMiner(addr net.Addr) {
 	// Establish RPC connection to server
 	miner2minerRPC, err := rpc.Dial("tcp", addr.String())
 	if err != nil {
-		fmt.Println(err.Error)
+		errLog.Println("Could not connect to miner", addr.String(), err)
+		return
 	}
+	addressBook.seen(addr.String())
 	minersConnectedTo.Lock()
 	defer minersConnectedTo.Unlock()
 
 	for _, addrAlreadyConnectedTo := range minersConnectedTo.all {
 		if addr.String() == addrAlreadyConnectedTo {
+			miner2minerRPC.Close()
 			return
 		}
 	}
 
 	minersConnectedTo.all = append(minersConnectedTo.all, addr.String())
+	minersConnectedTo.clients[addr.String()] = miner2minerRPC
 
 	reply := ""
 	err = miner2minerRPC.Call("MinerToMinerRPC.EstablishReverseRPC", myMinerInfo.Address.String(), &reply)
 	if err != nil {
-		fmt.Println("Issue with EstablishReverseRPC", err)
+		errLog.Println("Issue with EstablishReverseRPC", err)
 	}
-	fmt.Printf("Did other side connect to me?: %s\n", reply)
-	go handleMiner(*miner2minerRPC, addr)
+	debugLog.Printf("Did other side connect to me?: %s\n", reply)
+	go handleMiner(miner2minerRPC, addr)
 }
 
 /*
 A handler that handles all logic between two miners
 */
-func handleMiner(otherMiner rpc.Client, otherMinerAddr net.Addr) {
+func handleMiner(otherMiner *rpc.Client, otherMinerAddr net.Addr) {
 	defer otherMiner.Close()
 	minersConnectedTo.Lock()
 	minersConnectedTo.currentNumNeighbours = minersConnectedTo.currentNumNeighbours + 1
-	fmt.Printf("Curr num neighbours connected to: %d\n", minersConnectedTo.currentNumNeighbours)
+	debugLog.Printf("Curr num neighbours connected to: %d\n", minersConnectedTo.currentNumNeighbours)
 	minersConnectedTo.Unlock()
 	reply := ""
 	err := otherMiner.Call("MinerToMinerRPC.PrintText", "Hi from your neighbour!", &reply)
 	if err != nil {
-		fmt.Println("Issue with RPC call in handleMiner")
+		errLog.Println("Issue with RPC call in handleMiner")
 	}
-	fmt.Println(reply)
+	debugLog.Println(reply)
 	for {
-		fmt.Printf("Connection to neighbour %s is still alive\n", otherMinerAddr.String())
+		debugLog.Printf("Connection to neighbour %s is still alive\n", otherMinerAddr.String())
 		sleep_time := 5000 * time.Millisecond
 		time.Sleep(sleep_time)
+		if isShuttingDown() {
+			return
+		}
 
 		var reply string
-		fmt.Println("Sending block chain to neighbour")
+		debugLog.Println("Sending block chain to neighbour")
 
 		err := otherMiner.Call("MinerToMinerRPC.SendBlockChain", &blockChain, &reply)
 		if err != nil {
-			fmt.Println("SendblockChain RPC call err, ", err)
+			errLog.Println("SendblockChain RPC call err, ", err)
+			removeNeighbour(otherMinerAddr.String())
+			return
+		}
+		debugLog.Printf("Did other side receive it?: %s\n", reply)
+		addressBook.seen(otherMinerAddr.String())
+
+		var peers []PeerRecord
+		err = otherMiner.Call("MinerToMinerRPC.GetPeers", GetPeersArgs{myMinerInfo.Address.String()}, &peers)
+		if err != nil {
+			errLog.Println("GetPeers RPC call err, ", err)
+			continue
+		}
+		addressBook.merge(peers)
+	}
+}
+
+// Forgets a neighbour whose connection has failed so that
+// monitorNumConnections can replace it.
+func removeNeighbour(addr string) {
+	minersConnectedTo.Lock()
+	defer minersConnectedTo.Unlock()
+	for i, neighbour := range minersConnectedTo.all {
+		if neighbour == addr {
+			minersConnectedTo.all = append(minersConnectedTo.all[:i], minersConnectedTo.all[i+1:]...)
+			delete(minersConnectedTo.clients, addr)
+			minersConnectedTo.currentNumNeighbours--
+			outLog.Printf("Lost neighbour %s, now connected to %d\n", addr, minersConnectedTo.currentNumNeighbours)
+			return
 		}
-		fmt.Printf("Did other side receive it?: %s\n", reply)
 	}
 }
 
 /*********************************
-RPC calls for Artnodes to inkMiner
+Peer address book
 *********************************/
-func listenToArtnode(ipPort string) {
-	mRPC := new(MinerRPC)
+
+// Peers we have not heard from within this window are dropped.
+const peerExpiry = 24 * time.Hour
+
+// Maximum number of peers returned by a single GetPeers call.
+const maxPeersToShare = 16
+
+type PeerRecord struct {
+	Address  string
+	LastSeen int64 // unix nanoseconds
+}
+
+// Miners we have recently talked to, either directly or through a
+// neighbour's GetPeers reply. Persisted to disk so that a restarted miner
+// can find the network again without the server.
+type AddressBook struct {
+	sync.RWMutex
+	path  string
+	peers map[string]int64 // miner address -> last seen
+}
+
+// Records that we just talked to the miner at addr.
+func (b *AddressBook) seen(addr string) {
+	b.Lock()
+	defer b.Unlock()
+	b.peers[addr] = time.Now().UnixNano()
+}
+
+// Adds peers learned from a neighbour, keeping the most recent sighting.
+func (b *AddressBook) merge(records []PeerRecord) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now().UnixNano()
+	for _, r := range records {
+		if r.Address == "" || r.Address == localIPPortStr {
+			continue
+		}
+		lastSeen := r.LastSeen
+		if lastSeen > now {
+			lastSeen = now
+		}
+		if lastSeen > b.peers[r.Address] {
+			b.peers[r.Address] = lastSeen
+		}
+	}
+}
+
+// Returns at most n peers, most recently seen first, skipping ourselves and
+// any address for which skip returns true.
+func (b *AddressBook) recent(n int, skip func(addr string) bool) []PeerRecord {
+	b.RLock()
+	defer b.RUnlock()
+	records := make([]PeerRecord, 0, len(b.peers))
+	for addr, lastSeen := range b.peers {
+		if addr == localIPPortStr || (skip != nil && skip(addr)) {
+			continue
+		}
+		records = append(records, PeerRecord{addr, lastSeen})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].LastSeen > records[j].LastSeen })
+	if len(records) > n {
+		records = records[:n]
+	}
+	return records
+}
+
+// Drops peers that have not been seen within peerExpiry.
+func (b *AddressBook) prune() {
+	b.Lock()
+	defer b.Unlock()
+	cutoff := time.Now().Add(-peerExpiry).UnixNano()
+	for addr, lastSeen := range b.peers {
+		if lastSeen < cutoff {
+			delete(b.peers, addr)
+		}
+	}
+}
+
+func (b *AddressBook) load() error {
+	buffer, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []PeerRecord
+	if err := json.Unmarshal(buffer, &records); err != nil {
+		return err
+	}
+	b.merge(records)
+	b.prune()
+	return nil
+}
+
+func (b *AddressBook) save() error {
+	b.RLock()
+	n := len(b.peers)
+	b.RUnlock()
+	buffer, err := json.Marshal(b.recent(n, nil))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.path, buffer, 0644)
+}
+
+// Picks up to n peers from the address book that we are not already
+// connected to.
+func peersFromAddressBook(n int) []net.Addr {
+	minersConnectedTo.RLock()
+	connected := make(map[string]bool)
+	for _, addr := range minersConnectedTo.all {
+		connected[addr] = true
+	}
+	minersConnectedTo.RUnlock()
+
+	var addrs []net.Addr
+	for _, r := range addressBook.recent(n, func(addr string) bool { return connected[addr] }) {
+		addr, err := net.ResolveTCPAddr("tcp", r.Address)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+/*********************************
+Shutdown
+*********************************/
+
+// How long shutdown waits for in-flight art node RPCs to finish.
+const shutdownGracePeriod = 30 * time.Second
+
+// Counts in-flight art node RPCs so that shutdown can wait for them, and
+// refuses new ones once shutdown has started.
+type rpcTracker struct {
+	sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (t *rpcTracker) begin() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *rpcTracker) end() {
+	t.wg.Done()
+}
+
+// Refuses new RPCs and waits up to timeout for the in-flight ones.
+// Returns false if some RPCs were still running when the timeout expired.
+func (t *rpcTracker) drain(timeout time.Duration) bool {
+	t.Lock()
+	t.closed = true
+	t.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func isShuttingDown() bool {
+	select {
+	case <-shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Starts a graceful shutdown on SIGINT or SIGTERM. A second signal
+// exits right away.
+func handleSignals() {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	outLog.Printf("Received %s, shutting down\n", sig)
+	close(shutdownCh)
+
+	sig = <-sigCh
+	exitOnError("forced shutdown", fmt.Errorf("received %s during shutdown", sig))
+}
+
+/*
+Called from main once mining has stopped. Stops accepting art nodes and
+waits for the in-flight ones, saves state to disk, hangs up on the
+neighbours and tells the server we are gone.
+*/
+func shutdown(ipPort string) {
+	if artListener != nil {
+		artListener.Close()
+	}
+	if !artRPCs.drain(shutdownGracePeriod) {
+		errLog.Println("Gave up waiting for art node RPCs to finish")
+	}
+
+	if err := addressBook.save(); err != nil {
+		errLog.Println("Could not save address book:", err)
+	}
+
+	if minerListener != nil {
+		minerListener.Close()
+	}
+	closeNeighbours()
+
+	if err := unregisterFromServer(ipPort); err != nil {
+		errLog.Println("Could not unregister from server:", err)
+	}
+	outLog.Println("Miner shut down")
+}
+
+func closeNeighbours() {
+	minersConnectedTo.Lock()
+	defer minersConnectedTo.Unlock()
+	for addr, client := range minersConnectedTo.clients {
+		client.Close()
+		delete(minersConnectedTo.clients, addr)
+	}
+	minersConnectedTo.all = minersConnectedTo.all[:0]
+	minersConnectedTo.currentNumNeighbours = 0
+}
+
+func unregisterFromServer(ipPort string) error {
+	conn, err := net.DialTimeout("tcp", ipPort, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	cRPC := rpc.NewClient(conn)
+	defer cRPC.Close()
+	return cRPC.Call("RServer.Unregister", signKey("unregister"), &_ignored)
+}
+
+/*
+Blocks until the chain has grown validateNum blocks past lastOne. Gives up
+if the miner starts shutting down, since mining has stopped by then.
+*/
+func waitForConfirmations(lastOne int, validateNum uint8) error {
+	for {
+		last := len(blockChain) - 1
+		if last > lastOne+int(validateNum) {
+			return nil
+		}
+		select {
+		case <-shutdownCh:
+			return DisconnectedError("miner shut down before the operation was confirmed")
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+/*********************************
+RPC calls for Artnodes to inkMiner
+*********************************/
+func listenToArtnode(listenAddr string) {
+	mRPC := new(MinerRPC)
 	server := rpc.NewServer()
 	registerServer(server, mRPC)
-	l, e := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%s", artAppListenPort))
+	l, e := net.Listen("tcp", listenAddr)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
+	artListener = l
 
 	go server.Accept(l)
 	runtime.Gosched()
 }
 
-func (m *MinerRPC) Connect(minerprivatekey string, reply *ValidMiner) error {
+func (m *MinerRPC) Connect(minerprivatekey string, reply *ValidMiner) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	var v ValidMiner
 	// fmt.Println(getPrivKeyInStr(myPrivKey))
 	// fmt.Println(minerprivatekey)
@@ -654,7 +1727,13 @@ func (m *MinerRPC) Connect(minerprivatekey string, reply *ValidMiner) error {
 	return InvalidMinerPKError(minerprivatekey)
 }
 
-func (m *MinerRPC) GetInk(minerprivatekey string, reply *uint32) error {
+func (m *MinerRPC) GetInk(minerprivatekey string, reply *uint32) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	if myKeyPairInString == minerprivatekey {
 		remainInk := minerInkRemain()
 		// fmt.Println("@@@GetInk")
@@ -664,6 +1743,11 @@ func (m *MinerRPC) GetInk(minerprivatekey string, reply *uint32) error {
 	return InvalidMinerPKError(minerprivatekey)
 }
 
+// The canvas shapes are drawn on, from the network's settings.
+func canvasSize() (xMax int, yMax int) {
+	return int(settings.CanvasSettings.CanvasXMax), int(settings.CanvasSettings.CanvasYMax)
+}
+
 func minerInkRemain() uint32 {
 	if len(blockChain) == 0 {
 		return 0
@@ -674,76 +1758,438 @@ func minerInkRemain() uint32 {
 }
 
 // try to add a shape then return shapeHash, blockHash, remained ink
-func (m *MinerRPC) AddShape(args AddShapeStruct, reply *AddShapeReply) error {
+func (m *MinerRPC) AddShape(args AddShapeStruct, reply *AddShapeReply) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
 
-	svgStr := "<path d=\"" + args.ShapeSvgString + "\" stroke=\"" +
-		args.Stroke + "\" fill=\"" + args.Fill + "\"/>"
+	r, lastOne, err := addShapeBlock(args)
+	if err != nil {
+		return err
+	}
+	if err := waitForConfirmations(lastOne, args.ValidateNum); err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+
+// Adds all of the shapes in one op block, or none of them, and waits for
+// ValidateNum confirmations like AddShape.
+func (m *MinerRPC) AddShapes(args AddShapesArgs, reply *AddShapesReply) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	r, lastOne, err := addShapesBlock(args)
+	if err != nil {
+		return err
+	}
+	if err := waitForConfirmations(lastOne, args.ValidateNum); err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+
+// Like AddShape, but returns as soon as the op is in a block of our chain
+// instead of waiting for ValidateNum confirmations; the art node then
+// follows the op with GetConfirmations.
+func (m *MinerRPC) SubmitShape(args AddShapeStruct, reply *AddShapeReply) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	r, _, err := addShapeBlock(args)
+	if err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+
+// Where an op is in our chain.
+type OpStatus struct {
+	BlockHash string // block that added the op
+	Depth     int    // number of blocks on top of BlockHash
+}
+
+// Returns the block that added the shape and the number of blocks on top
+// of it. Fails with InvalidShapeHashError if the shape is not in our chain,
+// e.g. because its block was dropped for a longer chain, or was deleted
+// after it was last added, so that an art node drawing the same shape
+// again sends it rather than taking the old op for its own.
+func (m *MinerRPC) GetConfirmations(shapeHash string, status *OpStatus) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	chain := blockChain
+	index, _ := shapeOpIndex(chain, shapeHash, false)
+	deleted, _ := shapeOpIndex(chain, shapeHash, true)
+	if index < 0 || deleted > index {
+		return InvalidShapeHashError(shapeHash)
+	}
+	*status = OpStatus{blockHash(chain[index]), len(chain) - 1 - index}
+	return nil
+}
 
+// Returns whether the shape was deleted after it was last added to our
+// chain.
+func shapeDeleted(shapeHash string) bool {
+	chain := blockChain
+	added, _ := shapeOpIndex(chain, shapeHash, false)
+	deleted, _ := shapeOpIndex(chain, shapeHash, true)
+	return deleted > added
+}
+
+// A shape on the canvas, as GetCanvasState sends it.
+type CanvasShape struct {
+	ShapeHash      string
+	SvgString      string // the whole <path> element
+	ShapeSvgString string // the path data alone
+	Fill           string
+	Stroke         string
+	Owner          string // id of the art node that added the shape
+}
+
+// Returns the shapes on the canvas as of the block with the given hash;
+// the genesis hash gives the empty canvas.
+func (m *MinerRPC) GetCanvasState(hash string, shapes *[]CanvasShape) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	chain := blockChain
+	index, ok := chainIndex(chain, hash)
+	if !ok {
+		return InvalidBlockHashError(hash)
+	}
+
+	live := make([]CanvasShape, 0)
+	for _, op := range liveShapes(chain[:index+1]) {
+		live = append(live, CanvasShape{op.OpSig, op.AppShape, op.ShapeCommand, op.ShapeFill,
+			svgAttr(op.AppShape, "stroke"), artNodeID(op.PubKeyArtNode)})
+	}
+	*shapes = live
+	return nil
+}
+
+// Returns the index of the block with the given hash in chain, or -1 for
+// the genesis block. ok is false if the block is in neither.
+func chainIndex(chain []Block, hash string) (index int, ok bool) {
+	if hash == settings.GenesisBlockHash {
+		return -1, true
+	}
+	for i, h := range chainHashes(chain) {
+		if h == hash {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// A block of our chain, as GetBlock sends it.
+type BlockSummary struct {
+	Hash        string
+	PrevHash    string
+	Index       int // -1 for the genesis block
+	Nonce       uint32
+	NoOpBlock   bool
+	MinerPubKey string
+	Ops         []OpSummary // the ops this block added
+}
+
+// An op as GetBlock sends it.
+type OpSummary struct {
+	ShapeHash string
+	Delete    bool   // the op deletes ShapeHash rather than adding it
+	SvgString string // the added shape's <path> element
+	Owner     string // id of the art node that sent the op
+}
+
+// Returns the block with the given hash. The genesis block has no miner,
+// parent or ops.
+func (m *MinerRPC) GetBlock(hash string, summary *BlockSummary) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	chain := blockChain
+	index, ok := chainIndex(chain, hash)
+	if !ok {
+		return InvalidBlockHashError(hash)
+	}
+	if index < 0 {
+		*summary = BlockSummary{Hash: hash, Index: -1}
+		return nil
+	}
+
+	b := chain[index]
+	s := BlockSummary{hash, b.PrevHash, index, b.Nonce, b.NoOpBlock, b.PubKeyMiner, []OpSummary{}}
+	for _, op := range addedOps(chain, index) {
+		o := OpSummary{ShapeHash: op.OpSig, Owner: artNodeID(op.PubKeyArtNode)}
+		if op.AppShape == "delete" {
+			o.Delete = true
+		} else {
+			o.SvgString = op.AppShape
+		}
+		s.Ops = append(s.Ops, o)
+	}
+	*summary = s
+	return nil
+}
+
+// Returns the hash of the last block of our chain, or of the genesis block
+// if we have none yet.
+func (m *MinerRPC) GetChainTip(args int, tip *string) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	chain := blockChain
+	*tip = settings.GenesisBlockHash
+	if len(chain) > 0 {
+		*tip = blockHash(chain[len(chain)-1])
+	}
+	return nil
+}
+
+// Where a shape came from and what became of it, as GetShapeInfo sends it.
+type ShapeInfo struct {
+	ShapeHash        string
+	SvgString        string // the whole <path> element
+	ShapeSvgString   string // the path data alone
+	Fill             string
+	Owner            string // id of the art node that added the shape
+	MinerPubKey      string // miner of the block that added the shape
+	BlockHash        string // block that added the shape
+	BlockIndex       int
+	Depth            int // number of blocks on top of BlockHash
+	Deleted          bool
+	DeleteBlockHash  string // block that deleted the shape, if Deleted
+	DeleteBlockIndex int
+}
+
+// Returns where the shape was added in our chain, who added it, and
+// whether and where it was deleted since.
+func (m *MinerRPC) GetShapeInfo(shapeHash string, info *ShapeInfo) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	chain := blockChain
+	added, op := shapeOpIndex(chain, shapeHash, false)
+	if added < 0 {
+		return InvalidShapeHashError(shapeHash)
+	}
+	i := ShapeInfo{
+		ShapeHash:      shapeHash,
+		SvgString:      op.AppShape,
+		ShapeSvgString: op.ShapeCommand,
+		Fill:           op.ShapeFill,
+		Owner:          artNodeID(op.PubKeyArtNode),
+		MinerPubKey:    chain[added].PubKeyMiner,
+		BlockHash:      blockHash(chain[added]),
+		BlockIndex:     added,
+		Depth:          len(chain) - 1 - added,
+	}
+	if deleted, _ := shapeOpIndex(chain, shapeHash, true); deleted > added {
+		i.Deleted = true
+		i.DeleteBlockHash = blockHash(chain[deleted])
+		i.DeleteBlockIndex = deleted
+	}
+	*info = i
+	return nil
+}
+
+// Returns the index of the last block in chain that added the op adding
+// the shape, or deleting it if deletes is set, and the op; -1 if there is
+// none. A shape can be added again after it was deleted, so the last one
+// is the one that counts.
+func shapeOpIndex(chain []Block, shapeHash string, deletes bool) (int, Operation) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, op := range addedOps(chain, i) {
+			if op.OpSig == shapeHash && (op.AppShape == "delete") == deletes {
+				return i, op
+			}
+		}
+	}
+	return -1, Operation{}
+}
+
+// Returns the add ops of the shapes on the canvas at the end of chain, in
+// the order they were added. Ops are replayed block by block, so that a
+// shape deleted and later added again is on the canvas.
+func liveShapes(chain []Block) []Operation {
+	var live []Operation
+	for i := range chain {
+		for _, op := range addedOps(chain, i) {
+			if op.AppShape != "delete" {
+				live = append(live, op)
+				continue
+			}
+			for j := range live {
+				if live[j].OpSig == op.OpSig {
+					live = append(live[:j], live[j+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return live
+}
+
+// Returns the value of the attribute name in an svg element, or "".
+func svgAttr(element string, name string) string {
+	start := strings.Index(element, " "+name+"=\"")
+	if start < 0 {
+		return ""
+	}
+	value := element[start+len(name)+3:]
+	if end := strings.Index(value, "\""); end >= 0 {
+		return value[:end]
+	}
+	return ""
+}
+
+// Identifies the art node that added a shape without giving out the key
+// it proves ownership with. blockartlib.ArtNodeID gives the same id from
+// the art node's key.
+func artNodeID(artNodeKey string) string {
+	sum := sha256.Sum256([]byte(artNodeKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the hash of the shape among shapes, add ops of shapes on the
+// canvas, that covers point, which SvgHelper reports as "x,y" for an
+// overlap, or point itself if none does.
+func overlappedShape(shapes []Operation, point string) string {
+	canvasXMax, canvasYMax := canvasSize()
+	for _, op := range shapes {
+		points := make(map[string]SvgHelper.MapPoint)
+		if _, err := SvgHelper.AddShapeToMap(op.ShapeCommand, op.PubKeyArtNode, op.ShapeFill, math.MaxInt32, points, canvasXMax, canvasYMax); err != nil {
+			continue
+		}
+		if _, ok := points[point]; ok {
+			return op.OpSig
+		}
+	}
+	return point
+}
+
+// Validates the shape, and mines an op block for it on top of our chain.
+// Returns the reply for the art node and the index of the block the new
+// one was mined on.
+func addShapeBlock(args AddShapeStruct) (AddShapeReply, int, error) {
+	shape := ShapeSpec{args.SType, args.ShapeSvgString, args.Fill, args.Stroke}
+	r, lastOne, err := addShapesBlock(AddShapesArgs{args.ValidateNum, []ShapeSpec{shape}, args.ArtNodePK})
+	if err != nil {
+		return AddShapeReply{}, lastOne, err
+	}
+	return AddShapeReply{r.ShapeHashes[0], r.BlockHash, r.InkRemaining}, lastOne, nil
+}
+
+// Validates the shapes together, and mines one op block holding all of
+// them on top of our chain. Nothing is added unless every shape fits on
+// the canvas and the ink covers all of them. Returns the reply for the art
+// node and the index of the block the new one was mined on.
+func addShapesBlock(args AddShapesArgs) (AddShapesReply, int, error) {
 	lastOne := len(blockChain) - 1
-	var newBlock Block
-	var err1 error
 	remainInk := int(minerInkRemain())
 	if len(blockChain) == 0 {
-		newBlock, err1 = generateFirstBlock()
-		// lastOne = 0
-		return InsufficientInkError(remainInk)
+		return AddShapesReply{}, lastOne, InsufficientInkError(remainInk)
+	}
+	if len(args.Shapes) == 0 {
+		return AddShapesReply{}, lastOne, SvgHelper.InvalidShapeSvgStringError("no shapes to add")
 	}
 
 	lastBlk := blockChain[lastOne]
-	previousMap := lastBlk.CanvasInks
-	//fmt.Println("@@@ADDDD1", args.ShapeSvgString)
-	spentInk, err := SvgHelper.AddShapeToMap(args.ShapeSvgString, args.ArtNodePK, args.Fill,
-		remainInk, previousMap)
-
-	currentInkRemain := remainInk - spentInk
-	if err != nil {
-		return err
+	// Draw on a copy of the canvas, so that a shape failing halfway
+	// through the batch leaves no trace.
+	canvasInks := make(map[string]SvgHelper.MapPoint, len(lastBlk.CanvasInks))
+	for point, mapPoint := range lastBlk.CanvasInks {
+		canvasInks[point] = mapPoint
 	}
 
 	pkStr := getPubKeyInStr(myPrivKey.PublicKey)
-	shapeHash := computeNonceSecretHash(svgStr, pkStr) // use miner's public key
-	newOp := Operation{svgStr, shapeHash, args.ArtNodePK, args.ShapeSvgString, args.Fill}
+	canvasXMax, canvasYMax := canvasSize()
+	spentInk := 0
+	newOps := make([]Operation, 0, len(args.Shapes))
+	svgAndHashes := make([]string, 0, len(args.Shapes))
+	shapeHashes := make([]string, 0, len(args.Shapes))
+	for _, shape := range args.Shapes {
+		svgStr := "<path d=\"" + shape.ShapeSvgString + "\" stroke=\"" +
+			shape.Stroke + "\" fill=\"" + shape.Fill + "\"/>"
+		ink, err := SvgHelper.AddShapeToMap(shape.ShapeSvgString, args.ArtNodePK, shape.Fill,
+			remainInk-spentInk, canvasInks, canvasXMax, canvasYMax)
+		if overlap, ok := err.(SvgHelper.ShapeOverlapError); ok {
+			// The overlapped shape is on the chain, or earlier in this batch.
+			shapes := append(liveShapes(blockChain), newOps...)
+			err = SvgHelper.ShapeOverlapError(overlappedShape(shapes, string(overlap)))
+		}
+		if err != nil {
+			return AddShapesReply{}, lastOne, err
+		}
+		spentInk += ink
 
-	newBlock, err1 = generateBlock(blockChain[lastOne])
-	preHash, _ := calculateHash(blockChain[lastOne], settings.PoWDifficultyOpBlock)
+		shapeHash := computeNonceSecretHash(svgStr, pkStr) // use miner's public key
+		if contains(shapeHashes, shapeHash) {
+			return AddShapesReply{}, lastOne, SvgHelper.InvalidShapeSvgStringError("shape given twice: " + shape.ShapeSvgString)
+		}
+		newOps = append(newOps, Operation{svgStr, shapeHash, args.ArtNodePK, shape.ShapeSvgString, shape.Fill})
+		svgAndHashes = append(svgAndHashes, svgStr+":"+shapeHash)
+		shapeHashes = append(shapeHashes, shapeHash)
+	}
 
-	newOps := blockChain[lastOne].Ops
-	newOps = append(newOps, newOp)
-	mInks := blockChain[lastOne].MinerInks
+	preHash, _ := calculateHash(lastBlk, settings.PoWDifficultyOpBlock)
+
+	ops := append(append([]Operation{}, lastBlk.Ops...), newOps...)
+	mInks := lastBlk.MinerInks
 	incAcc := mInks[globalPubKeyStr]
 
 	_, inkMined := totalInkSpentAndMinedByMiner(blockChain, pkStr)
 	incAcc.InkMined = inkMined
 	incAcc.InkSpent = uint32(spentInk) + incAcc.InkSpent
 	incAcc.InkRemain = inkMined - incAcc.InkSpent
-	fmt.Printf("@@@in incAcc inkMined!!!! %d-----------inkSpent!!!! %d-------incAcc.inkRemain %d-------\n", inkMined, incAcc.InkSpent, incAcc.InkRemain)
+	debugLog.Printf("@@@in incAcc inkMined!!!! %d-----------inkSpent!!!! %d-------incAcc.inkRemain %d-------\n", inkMined, incAcc.InkSpent, incAcc.InkRemain)
 
 	mInks[globalPubKeyStr] = incAcc
-	canvOps := blockChain[lastOne].CanvasOperations
-	myOps := canvOps[globalPubKeyStr]
-	svgAndHash := svgStr + ":" + shapeHash
-	myOps = append(myOps, svgAndHash)
-	canvOps[globalPubKeyStr] = myOps
-	newBlock = Block{preHash, 0, newOps, false, globalPubKeyStr, lastOne + 1, mInks,
-		previousMap, canvOps}
+	canvOps := lastBlk.CanvasOperations
+	canvOps[globalPubKeyStr] = append(canvOps[globalPubKeyStr], svgAndHashes...)
+	newBlock := Block{preHash, 0, ops, false, globalPubKeyStr, lastOne + 1, mInks,
+		canvasInks, canvOps}
 	blockHash, nonce := calculateHash(newBlock, settings.PoWDifficultyOpBlock)
 	tmp, _ := strconv.ParseUint(nonce, 10, 32)
 	newBlock.Nonce = uint32(tmp)
 	blockChain = append(blockChain, newBlock)
-	//fmt.Println("@@@ADD3DD")
 
-	for {
-		last := len(blockChain) - 1
-		if last > lastOne+int(args.ValidateNum) {
-			break
-		}
-		time.Sleep(3 * time.Second)
-	}
-	*reply = AddShapeReply{shapeHash, blockHash, uint32(currentInkRemain)}
-	return err1
+	return AddShapesReply{shapeHashes, blockHash, uint32(remainInk - spentInk)}, lastOne, nil
 }
 
-func (m *MinerRPC) GetSvgString(shapeHash string, svgString *string) error {
+func (m *MinerRPC) GetSvgString(shapeHash string, svgString *string) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	lastOne := len(blockChain) - 1
 	operations := blockChain[lastOne].CanvasOperations
 	for _, ops := range operations {
@@ -761,11 +2207,21 @@ func (m *MinerRPC) GetSvgString(shapeHash string, svgString *string) error {
 	return InvalidShapeHashError(shapeHash)
 }
 
-func (m *MinerRPC) DeleteShape(args DelShapeArgs, inkRemaining *uint32) error {
+func (m *MinerRPC) DeleteShape(args DelShapeArgs, inkRemaining *uint32) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	lastOne := len(blockChain) - 1
 	if lastOne < 0 {
 		return InvalidShapeHashError(args.ShapeHash)
 	}
+	// A delete retried by an art node must not return the ink twice.
+	if shapeDeleted(args.ShapeHash) {
+		return InvalidShapeHashError(args.ShapeHash)
+	}
 
 	//fmt.Print("##KKK(99999)6KK", len(blockChain))
 	for k := 1; k < lastOne; k++ {
@@ -793,8 +2249,9 @@ func (m *MinerRPC) DeleteShape(args DelShapeArgs, inkRemaining *uint32) error {
 					incAcc := mInks[globalPubKeyStr]
 					previousMap := lastBlk.CanvasInks
 
+					xMax, yMax := canvasSize()
 					returnedInk, err2 := SvgHelper.RemoveShapeFromMap(operations[i].ShapeCommand, args.ArtNodePK,
-						operations[i].ShapeFill, previousMap)
+						operations[i].ShapeFill, previousMap, xMax, yMax)
 
 					incAcc.InkRemain = incAcc.InkRemain + uint32(returnedInk)
 					incAcc.InkSpent = incAcc.InkSpent - uint32(returnedInk)
@@ -813,12 +2270,8 @@ func (m *MinerRPC) DeleteShape(args DelShapeArgs, inkRemaining *uint32) error {
 					newBlock.Nonce = uint32(tmp)
 					blockChain = append(blockChain, newBlock)
 
-					for {
-						last := len(blockChain) - 1
-						if last > lastOne+int(args.ValidateNum) {
-							break
-						}
-						time.Sleep(3 * time.Second)
+					if err := waitForConfirmations(lastOne, args.ValidateNum); err != nil {
+						return err
 					}
 					ink := blockChain[lastOne].MinerInks[globalPubKeyStr]
 					*inkRemaining = ink.InkRemain
@@ -832,7 +2285,13 @@ func (m *MinerRPC) DeleteShape(args DelShapeArgs, inkRemaining *uint32) error {
 	return InvalidShapeHashError(args.ShapeHash)
 }
 
-func (m *MinerRPC) GetShapes(blockHash string, shapeHashes *[]string) error {
+func (m *MinerRPC) GetShapes(blockHash string, shapeHashes *[]string) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	var tmpHashs []string
 	lastOne := len(blockChain) - 1
 	if lastOne < 0 {
@@ -869,12 +2328,23 @@ func (m *MinerRPC) GetShapes(blockHash string, shapeHashes *[]string) error {
 	return InvalidBlockHashError(blockHash)
 }
 
-func (m *MinerRPC) GetGenesisBlock(args int, blockHash *string) error {
+func (m *MinerRPC) GetGenesisBlock(args int, blockHash *string) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	*blockHash = settings.GenesisBlockHash
 	return nil
 }
 
-func (m *MinerRPC) GetChildren(blockHash string, blockHashes *[]string) error {
+func (m *MinerRPC) GetChildren(blockHash string, blockHashes *[]string) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
 
 	lastOne := len(blockChain) - 1
 	if lastOne < 0 {
@@ -899,7 +2369,149 @@ func (m *MinerRPC) GetChildren(blockHash string, blockHashes *[]string) error {
 	return InvalidBlockHashError(blockHash)
 }
 
-func (m *MinerRPC) CloseCanvas(args int, reply *CloseCanvReply) error {
+/*********************************
+Chain events for art nodes
+*********************************/
+
+type EventType int
+
+const (
+	NewBlockEvent EventType = iota
+	ShapeAddedEvent
+	ShapeDeletedEvent
+	ReorgEvent
+)
+
+// A change to our chain, as reported to art nodes by WatchChain.
+type CanvasEvent struct {
+	Type        EventType
+	BlockHash   string // for ReorgEvent, the last block the art node saw that is still in the chain
+	BlockIndex  int
+	MinerPubKey string
+	ShapeHash   string
+	SvgString   string
+	Fill        string
+}
+
+type WatchArgs struct {
+	Known   []string // hashes of the blocks the art node has seen, newest first
+	FromTip bool     // only return the current tip
+	Wait    int      // milliseconds to wait for new blocks if there are none
+}
+
+type WatchReply struct {
+	Tip    string
+	Events []CanvasEvent
+}
+
+// How often WatchChain looks for new blocks while waiting.
+const watchPollInterval = 250 * time.Millisecond
+
+/*
+Returns the events for the blocks after the newest of args.Known that is
+still in our chain, waiting up to args.Wait milliseconds for some to come.
+If the art node's newest block is gone, the events start with a
+ReorgEvent. With no Known blocks, the events cover the whole chain.
+*/
+func (m *MinerRPC) WatchChain(args WatchArgs, reply *WatchReply) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
+	deadline := time.Now().Add(time.Duration(args.Wait) * time.Millisecond)
+	for {
+		chain := blockChain
+		hashes := chainHashes(chain)
+		tip := settings.GenesisBlockHash
+		if len(chain) > 0 {
+			tip = hashes[len(chain)-1]
+		}
+		if args.FromTip {
+			*reply = WatchReply{Tip: tip}
+			return nil
+		}
+
+		events := chainEvents(chain, hashes, args.Known)
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			*reply = WatchReply{tip, events}
+			return nil
+		}
+		select {
+		case <-shutdownCh:
+			*reply = WatchReply{Tip: tip}
+			return nil
+		case <-time.After(watchPollInterval):
+		}
+	}
+}
+
+// Lists the events of chain after the newest known block in it.
+func chainEvents(chain []Block, hashes []string, known []string) []CanvasEvent {
+	var events []CanvasEvent
+	start := 0
+	if len(known) > 0 {
+		index := make(map[string]int, len(hashes)+1)
+		index[settings.GenesisBlockHash] = -1
+		for i, hash := range hashes {
+			index[hash] = i
+		}
+		fork := ""
+		for _, hash := range known {
+			if i, ok := index[hash]; ok {
+				start = i + 1
+				fork = hash
+				break
+			}
+		}
+		if fork != known[0] {
+			events = append(events, CanvasEvent{Type: ReorgEvent, BlockHash: fork})
+		}
+	}
+
+	for i := start; i < len(chain); i++ {
+		b := chain[i]
+		events = append(events, CanvasEvent{Type: NewBlockEvent, BlockHash: hashes[i], BlockIndex: i, MinerPubKey: b.PubKeyMiner})
+		for _, op := range addedOps(chain, i) {
+			event := CanvasEvent{BlockHash: hashes[i], BlockIndex: i, MinerPubKey: b.PubKeyMiner, ShapeHash: op.OpSig}
+			if op.AppShape == "delete" {
+				event.Type = ShapeDeletedEvent
+			} else {
+				event.Type = ShapeAddedEvent
+				event.SvgString = op.AppShape
+				event.Fill = op.ShapeFill
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Returns the ops chain[i] added. An op block starts with the ops of the
+// block before it and a no-op block has none, so these are the ops after
+// that prefix. Comparing by position rather than by op keeps a shape that
+// is added again after being deleted.
+func addedOps(chain []Block, i int) []Operation {
+	ops := chain[i].Ops
+	if i == 0 || len(chain[i-1].Ops) > len(ops) {
+		return ops
+	}
+	for j, op := range chain[i-1].Ops {
+		if ops[j] != op {
+			return ops
+		}
+	}
+	return ops[len(chain[i-1].Ops):]
+}
+
+func (m *MinerRPC) CloseCanvas(args int, reply *CloseCanvReply) (err error) {
+	defer envelopeError(&err)
+	if !artRPCs.begin() {
+		return DisconnectedError("miner is shutting down")
+	}
+	defer artRPCs.end()
+
 	//fmt.Println("@@@ CloseCanvas")
 	lastOne := len(blockChain) - 1
 	if lastOne < 0 {
@@ -917,8 +2529,8 @@ func (m *MinerRPC) CloseCanvas(args int, reply *CloseCanvReply) error {
 RPC calls for inkMIner to inkMiner
 *********************************/
 func (m *MinerToMinerRPC) PrintText(textToPrint string, reply *string) error {
-	fmt.Println("Inside PrintText")
-	fmt.Println(textToPrint)
+	debugLog.Println("Inside PrintText")
+	debugLog.Println(textToPrint)
 	*reply = "We printed the text you requested"
 	return nil
 }
@@ -934,8 +2546,10 @@ func (m *MinerToMinerRPC) EstablishReverseRPC(addr string, reply *string) error
 	}
 	addrTCP, e := net.ResolveTCPAddr("tcp", addr)
 	if e != nil {
-		fmt.Println("Error resolving address in EstablishReverseRPC")
+		errLog.Println("Error resolving address in EstablishReverseRPC")
+		return e
 	}
+	addressBook.seen(addr)
 	go connectToMiner(addrTCP)
 	*reply = "Successfully established reverse connection"
 	return nil
@@ -944,7 +2558,7 @@ func (m *MinerToMinerRPC) EstablishReverseRPC(addr string, reply *string) error
 func (m *MinerToMinerRPC) SendBlockChain(bc []Block, reply *string) error {
 	// 1. Check if the sent block is longer than our block.
 	if isSentChainLonger(bc) {
-		fmt.Println("sbc: Received a longer chain than what we have.")
+		debugLog.Println("sbc: Received a longer chain than what we have.")
 		// 1.2 If the sent block <bc> is longer, validate that it is a good block chain
 		// if validateSufficientInkAll(bc) {
 		// 	// 2.2 Otherwise acquire the lock for global blockchain and set it to sent block
@@ -963,6 +2577,23 @@ func (m *MinerToMinerRPC) SendBlockChain(bc []Block, reply *string) error {
 	return nil
 }
 
+type GetPeersArgs struct {
+	Address string // miner-to-miner address of the miner asking for peers
+}
+
+// Returns the peers we have recently heard from so that the caller can find
+// other miners without asking the server. The caller is recorded as seen.
+func (m *MinerToMinerRPC) GetPeers(args GetPeersArgs, reply *[]PeerRecord) error {
+	if args.Address != "" {
+		addressBook.seen(args.Address)
+	}
+	peers := addressBook.recent(maxPeersToShare, func(addr string) bool {
+		return addr == args.Address
+	})
+	*reply = peers
+	return nil
+}
+
 func registerServer(server *rpc.Server, s MinerRPCs) {
 	// registers interface by name of `MyServer`.
 	server.RegisterName("InkMinerRPC", s)
@@ -1005,21 +2636,29 @@ func getPubKeyInStr(pubKey ecdsa.PublicKey) string {
 	return str
 }
 
-func listenForIncomingConnections(port int) {
+func listenForIncomingConnections(listenAddr string) {
 	gob.Register(&net.TCPAddr{})
 	minerToMinerRPC := new(MinerToMinerRPC)
 
 	server := rpc.NewServer()
 	registerServerMinerToMiner(server, minerToMinerRPC)
 
-	l, e := net.Listen("tcp", fmt.Sprintf("%s:%d", localIPPortArr[0], port))
+	l, e := net.Listen("tcp", listenAddr)
 	if e != nil {
 		exitOnError("Error listening in for incoming connection requests", e)
 	}
+	minerListener = l
 
 	for {
-		conn, _ := l.Accept()
-		fmt.Println("Received a connection request")
+		conn, err := l.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			errLog.Println("Error accepting connection request", err)
+			continue
+		}
+		debugLog.Println("Received a connection request")
 		go server.ServeConn(conn)
 	}
 }
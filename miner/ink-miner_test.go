@@ -1,14 +1,173 @@
-package ink-miner
+package main
 
 import (
+	"strings"
 	"testing"
+)
+
+// A chain of n no-op blocks mined by miner.
+func testChain(n int, miner string) []Block {
+	chain := make([]Block, 0, n+1)
+	for i := 0; i < n; i++ {
+		chain = append(chain, Block{PrevHash: "prev", NoOpBlock: true, PubKeyMiner: miner, Index: i})
+	}
+	return chain
+}
+
+func TestChainHashes(t *testing.T) {
+	chain := testChain(3, "a")
+	hashes := chainHashes(chain)
+	if len(hashes) != 3 {
+		t.Fatal("Expected 3 hashes, got: ", hashes)
+	}
+	for i, b := range chain {
+		if hashes[i] != blockHash(b) {
+			t.Errorf("Expected hash %d to be %s, got: %s", i, blockHash(b), hashes[i])
+		}
+	}
+	if again := chainHashes(chain); &again[0] != &hashes[0] {
+		t.Error("Expected the hashes of an unchanged chain to be shared")
+	}
+
+	// Our chain grows by appending to the same backing array.
+	chain = append(chain, Block{PrevHash: "prev", NoOpBlock: true, PubKeyMiner: "a", Index: 3})
+	grown := chainHashes(chain)
+	if len(grown) != 4 || grown[0] != hashes[0] || grown[3] != blockHash(chain[3]) {
+		t.Error("Expected the hashes of the grown chain, got: ", grown)
+	}
+	if prefix := chainHashes(chain[:2]); len(prefix) != 2 || prefix[1] != hashes[1] {
+		t.Error("Expected the hashes of the first 2 blocks, got: ", prefix)
+	}
 
+	other := testChain(2, "b")
+	if got := chainHashes(other); len(got) != 2 || got[0] != blockHash(other[0]) || got[0] == hashes[0] {
+		t.Error("Expected a replaced chain to be hashed again, got: ", got)
+	}
+}
+
+var (
+	addA = Operation{`<path d="M 0 0 L 5 0"/>`, "a", "key", "M 0 0 L 5 0", "transparent"}
+	addB = Operation{`<path d="M 0 9 L 5 9"/>`, "b", "key", "M 0 9 L 5 9", "transparent"}
+	delA = Operation{"delete", "a", "key", "", ""}
 )
 
-func TestIntersect(t *testing.T) {
-	// test stuff here...
-	intersect = doesIntersect()
-	if intersect != false {
-		t.Error("Expected false, got: ", intersect)
+// A chain that adds a and b, deletes a and adds it again. Each op block
+// carries the ops of the block before it, unless that is a no-op block.
+func testOpChain() []Block {
+	return []Block{
+		{NoOpBlock: true, Index: 0},
+		{Ops: []Operation{addA}, Index: 1},
+		{Ops: []Operation{addA, addB}, Index: 2},
+		{NoOpBlock: true, Index: 3},
+		{Ops: []Operation{delA}, Index: 4},
+		{Ops: []Operation{delA, addA}, Index: 5},
+	}
+}
+
+func TestAddedOps(t *testing.T) {
+	chain := testOpChain()
+	tests := []struct {
+		index int
+		want  []Operation
+	}{
+		{0, nil},
+		{1, []Operation{addA}},
+		{2, []Operation{addB}},
+		{3, nil},
+		{4, []Operation{delA}},
+		{5, []Operation{addA}},
+	}
+	for _, test := range tests {
+		if got := addedOps(chain, test.index); !sameOps(got, test.want) {
+			t.Errorf("addedOps(%d) = %v, want %v", test.index, got, test.want)
+		}
+	}
+
+	// Ops that do not start with the previous block's are all new.
+	chain[2].Ops = []Operation{addB}
+	if got := addedOps(chain, 2); !sameOps(got, []Operation{addB}) {
+		t.Error("Expected only b, got: ", got)
+	}
+}
+
+func TestLiveShapes(t *testing.T) {
+	chain := testOpChain()
+	if got := liveShapes(chain[:3]); !sameOps(got, []Operation{addA, addB}) {
+		t.Error("Expected a and b, got: ", got)
+	}
+	if got := liveShapes(chain[:5]); !sameOps(got, []Operation{addB}) {
+		t.Error("Expected only b after a was deleted, got: ", got)
+	}
+	if got := liveShapes(chain); !sameOps(got, []Operation{addB, addA}) {
+		t.Error("Expected a back after b, got: ", got)
+	}
+}
+
+func TestShapeOpIndex(t *testing.T) {
+	chain := testOpChain()
+	tests := []struct {
+		blocks  int
+		hash    string
+		deletes bool
+		index   int
+	}{
+		{6, "a", false, 5}, // the re-add, not the first add
+		{5, "a", false, 1},
+		{6, "a", true, 4},
+		{3, "a", true, -1},
+		{6, "b", false, 2},
+		{6, "c", false, -1},
+	}
+	for _, test := range tests {
+		if index, _ := shapeOpIndex(chain[:test.blocks], test.hash, test.deletes); index != test.index {
+			t.Errorf("shapeOpIndex(%d blocks, %s, %v) = %d, want %d", test.blocks, test.hash, test.deletes, index, test.index)
+		}
+	}
+	if _, op := shapeOpIndex(chain, "a", true); op != delA {
+		t.Error("Expected the delete op, got: ", op)
+	}
+}
+
+func TestShapeDeleted(t *testing.T) {
+	saved := blockChain
+	defer func() { blockChain = saved }()
+
+	chain := testOpChain()
+	blockChain = chain[:5]
+	if !shapeDeleted("a") || shapeDeleted("b") {
+		t.Error("Expected only a to be deleted")
+	}
+	blockChain = chain
+	if shapeDeleted("a") {
+		t.Error("Expected a re-added shape not to be deleted")
+	}
+}
+
+func TestGetConfirmationsOfDeletedShape(t *testing.T) {
+	saved := blockChain
+	defer func() { blockChain = saved }()
+
+	chain := testOpChain()
+	var m MinerRPC
+	var status OpStatus
+	blockChain = chain[:5]
+	if err := m.GetConfirmations("a", &status); err == nil || !strings.Contains(err.Error(), "InvalidShapeHashError") {
+		t.Error("Expected a deleted shape to be unknown, got: ", err)
+	}
+	blockChain = chain
+	if err := m.GetConfirmations("a", &status); err != nil || status != (OpStatus{blockHash(chain[5]), 0}) {
+		t.Error("Expected the block that added a again, got: ", status, err)
+	}
+}
+
+func sameOps(a, b []Operation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
+	return true
 }
@@ -3,36 +3,111 @@
 Implements an example server for the BlockArt project, to be used in
 project 1 of UBC CS 416 2017W2.
 
-This server takes in settings from an input json files and implements
-a simple strategy for GetNodes: return a fixed number of random miners
-("num-miner-to-return" in the json config file).
+This server takes in settings from an input json files and returns up
+to "num-miner-to-return" miners from GetNodes. Which miners are returned
+is decided by "get-nodes-strategy":
+
+  random            a shuffle seeded by the caller's key (the default)
+  random-regular    random miners, preferring those below "max-degree"
+  ring-plus-chords  ring neighbours plus chords at power-of-two distances
+  least-connected   the miners with the fewest connections
+
+Every strategy except "random" uses the server's model of the miner
+graph: it never returns miners that already have "max-degree"
+connections (when set), and prefers miners outside the caller's
+connected component so that partitions get joined up.
+
+If "registry-path" is set in the config, registrations and their last
+heartbeat times are saved to that file and restored when the server
+starts, so that miners can keep heartbeating across a server restart.
+Registrations are saved as soon as they change; heartbeat times are saved
+once a minute and when the server exits on SIGINT or SIGTERM.
+Restored miners have "registry-grace" milliseconds (default: three
+heartbeat intervals) to send their next heartbeat.
+
+One server can host several separate canvases. Each entry of "networks"
+in the config is a named network with its own miner settings (genesis
+hash, canvas size, difficulty, ink rewards, ...); miners name the network
+they join in Register and GetNodes, and only ever get peers from their
+own network. A top-level "miner-settings" defines the network named
+"default", which is also used when a miner does not name one.
+
+Miners have to prove they hold the private key for the public key they
+register: Register carries a signature over a nonce handed out by
+GetRegistrationNonce, and HeartBeat, Unregister, GetNodes and
+ReportNeighbours carry a signed, strictly increasing timestamp.
+
+If "admin-http-addr" is set, the server also serves JSON over HTTP on that
+address for dashboards and scripts:
+
+  /miners     registered miners, their addresses, heartbeat ages and tips
+  /settings   the MinerNetSettings of each network
+  /topology   the server's network graph and its connected components
+  /reload     (POST) reloads the config file, like SIGHUP; only served
+              when "admin-token" is set, and the request must carry
+              "Authorization: Bearer <admin-token>"
+
+The config is reloaded on SIGHUP or a POST to /reload. Only fields that are
+safe to change while miners are running are picked up: num-miner-to-return,
+get-nodes-strategy, max-degree, registry-grace, admin-token, new networks,
+and the heartbeat of existing networks. A new heartbeat applies to the miners
+already registered right away; they poll it with HeartBeatInterval. A
+reload that changes anything else (a network's genesis hash, ink rewards,
+PoW difficulty or canvas size, which would fork its miners, its
+min-num-miner-connections, which miners only get when they register, or
+the listen addresses and registry path, which need a restart) is rejected
+as a whole and the running config is kept.
+
+The config is validated when it is loaded (and reloaded), and every problem
+is reported with the path of its field, e.g.
+"networks.team-canvas.canvas-settings.canvas-x-max: must be at least 1".
+Top-level fields left out of the config take the defaults printed by
+-print-default-config. A network's settings have no defaults: every field
+of "miner-settings" and of each entry of "networks" must be given, and a
+missing one is reported like "networks.team-canvas.heartbeat: is required".
 
 Usage:
 
 $ go run server.go
   -c string
     	Path to the JSON config
+  -print-default-config
+    	Print a config with the default settings (and a fresh genesis
+    	block hash) and exit
 
 */
 
 package main
 
 import (
+	"container/heap"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math/big"
+	mathrand "math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -45,12 +120,52 @@ func (e KeyAlreadyRegisteredError) Error() string {
 	return fmt.Sprintf("BlockArt server: key already registered [%s]", string(e))
 }
 
+type UnknownNetworkError string
+
+func (e UnknownNetworkError) Error() string {
+	return fmt.Sprintf("BlockArt server: unknown network [%s]", string(e))
+}
+
 type AddressAlreadyRegisteredError string
 
 func (e AddressAlreadyRegisteredError) Error() string {
 	return fmt.Sprintf("BlockArt server: address already registered [%s]", string(e))
 }
 
+type InvalidSignatureError string
+
+func (e InvalidSignatureError) Error() string {
+	return fmt.Sprintf("BlockArt server: invalid signature [%s]", string(e))
+}
+
+// Contains the unknown/expired nonce, or the rejected timestamp.
+type StaleRequestError string
+
+func (e StaleRequestError) Error() string {
+	return fmt.Sprintf("BlockArt server: stale or replayed request [%s]", string(e))
+}
+
+// Every problem found in a config, each prefixed by its field path.
+type InvalidConfigError []string
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("BlockArt server: invalid config [%s]", strings.Join(e, "; "))
+}
+
+// Contains the number of registration nonces handed out within the last
+// nonceLifetime.
+type TooManyNoncesError int
+
+func (e TooManyNoncesError) Error() string {
+	return fmt.Sprintf("BlockArt server: too many registration nonces, try again later [%d]", int(e))
+}
+
+type ConfigReloadError string
+
+func (e ConfigReloadError) Error() string {
+	return fmt.Sprintf("BlockArt server: config not reloaded [%s]", string(e))
+}
+
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
@@ -94,7 +209,7 @@ type MinerNetSettings struct {
 	// Number of milliseconds between heartbeat messages to the server.
 	HeartBeat uint32 `json:"heartbeat"`
 
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
+	// Proof of work difficulty: number of zeroes in prefix (>= 1)
 	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 
@@ -102,42 +217,477 @@ type MinerNetSettings struct {
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
 }
 
+// Settings printed by -print-default-config. The genesis block hash is
+// left out, so that two networks never share one by accident.
+var defaultMinerNetSettings = MinerNetSettings{
+	MinNumMinerConnections: 2,
+	InkPerOpBlock:          500,
+	InkPerNoOpBlock:        250,
+	HeartBeat:              10000,
+	PoWDifficultyOpBlock:   3,
+	PoWDifficultyNoOpBlock: 3,
+	CanvasSettings:         CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+}
+
+// JSON names of the fields every network's settings must give.
+var requiredNetFields = []string{
+	"genesis-block-hash",
+	"min-num-miner-connections",
+	"ink-per-op-block",
+	"ink-per-no-op-block",
+	"heartbeat",
+	"pow-difficulty-op-block",
+	"pow-difficulty-no-op-block",
+	"canvas-settings",
+}
+
+var requiredCanvasFields = []string{"canvas-x-max", "canvas-y-max"}
+
+// Appends "path.field: is required" for every required field missing
+// from data, the JSON of one network's settings.
+func missingNetFields(path string, data json.RawMessage, problems []string) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		// Reported by the decoding of the whole config.
+		return problems
+	}
+	for _, field := range requiredNetFields {
+		if _, ok := fields[field]; !ok {
+			problems = append(problems, path+"."+field+": is required")
+		}
+	}
+	if canvas, ok := fields["canvas-settings"]; ok {
+		var canvasFields map[string]json.RawMessage
+		if json.Unmarshal(canvas, &canvasFields) == nil {
+			for _, field := range requiredCanvasFields {
+				if _, ok := canvasFields[field]; !ok {
+					problems = append(problems, path+".canvas-settings."+field+": is required")
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// Returns the required network fields missing from buffer, a config file.
+func missingConfigFields(buffer []byte) []string {
+	var raw struct {
+		MinerSettings json.RawMessage            `json:"miner-settings"`
+		Networks      map[string]json.RawMessage `json:"networks"`
+	}
+	if err := json.Unmarshal(buffer, &raw); err != nil {
+		return nil
+	}
+	var problems []string
+	if len(raw.MinerSettings) > 0 && string(raw.MinerSettings) != "null" {
+		problems = missingNetFields("miner-settings", raw.MinerSettings, problems)
+	}
+	ids := make([]string, 0, len(raw.Networks))
+	for id := range raw.Networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		problems = missingNetFields("networks."+id, raw.Networks[id], problems)
+	}
+	return problems
+}
+
+// Length of a block hash in hex (md5); PoW difficulty cannot exceed it.
+const hashHexLen = 32
+
+// Appends a problem for every field of s that is out of range, prefixed
+// with path.
+func (s MinerNetSettings) validate(path string, problems []string) []string {
+	problem := func(field, msg string) {
+		problems = append(problems, path+"."+field+": "+msg)
+	}
+	if s.GenesisBlockHash == "" {
+		problem("genesis-block-hash", "is required")
+	} else if _, err := hex.DecodeString(s.GenesisBlockHash); err != nil {
+		problem("genesis-block-hash", "must be hex")
+	}
+	if s.MinNumMinerConnections < 1 {
+		problem("min-num-miner-connections", "must be at least 1")
+	}
+	if s.InkPerOpBlock < 1 {
+		problem("ink-per-op-block", "must be at least 1")
+	}
+	if s.InkPerNoOpBlock < 1 {
+		problem("ink-per-no-op-block", "must be at least 1")
+	}
+	if s.HeartBeat < 1 {
+		problem("heartbeat", "must be at least 1")
+	}
+	if s.PoWDifficultyOpBlock < 1 || s.PoWDifficultyOpBlock > hashHexLen {
+		problem("pow-difficulty-op-block", fmt.Sprintf("must be between 1 and %d", hashHexLen))
+	}
+	if s.PoWDifficultyNoOpBlock < 1 || s.PoWDifficultyNoOpBlock > hashHexLen {
+		problem("pow-difficulty-no-op-block", fmt.Sprintf("must be between 1 and %d", hashHexLen))
+	}
+	if s.CanvasSettings.CanvasXMax < 1 {
+		problem("canvas-settings.canvas-x-max", "must be at least 1")
+	}
+	if s.CanvasSettings.CanvasYMax < 1 {
+		problem("canvas-settings.canvas-y-max", "must be at least 1")
+	}
+	return problems
+}
+
 type RServer int
 
 type Miner struct {
 	Address         net.Addr
-	RecentHeartbeat int64
+	NetworkID       string
+	RecentHeartbeat int64         // unix nanoseconds, accessed atomically
+	HeartBeat       time.Duration // interval of the miner's network, guarded by allMiners
+
+	// Timestamp of the last signed HeartBeat, accessed atomically. Each
+	// one must be newer so that a heartbeat cannot be replayed.
+	LastSignedTimestamp int64
+	// Likewise for GetNodes and ReportNeighbours. They are kept apart from
+	// heartbeats, which the miner sends from another goroutine and so
+	// may arrive out of order with them.
+	LastNodesTimestamp  int64
+	LastReportTimestamp int64
+
+	// Filled in from the miner's latest ReportNeighbours call.
+	Neighbours  []string // addresses of the miners it is connected to
+	ChainTip    string   // hash of the last block of its chain
+	ChainLength int
+	LastReport  int64
+}
+
+// Name of the network defined by the top-level "miner-settings", and used
+// when a miner does not give a network ID.
+const defaultNetwork = "default"
+
+// Defaults for the fields missing from a config file.
+func defaultConfig() Config {
+	return Config{
+		RpcIpPort:        "127.0.0.1:12345",
+		NumMinerToReturn: 4,
+		GetNodesStrategy: "random",
+	}
+}
+
+// Returns a problem for every invalid field of c, before the top-level
+// miner-settings has been folded into Networks.
+func (c Config) validate() []string {
+	var problems []string
+	if err := validateAddr(c.RpcIpPort); err != nil {
+		problems = append(problems, "rpc-ip-port: "+err.Error())
+	}
+	if c.AdminHttpAddr != "" {
+		if err := validateAddr(c.AdminHttpAddr); err != nil {
+			problems = append(problems, "admin-http-addr: "+err.Error())
+		}
+	}
+	if c.NumMinerToReturn < 1 {
+		problems = append(problems, "num-miner-to-return: must be at least 1")
+	}
+	if _, ok := peerSelectors[c.GetNodesStrategy]; !ok {
+		problems = append(problems, fmt.Sprintf("get-nodes-strategy: unknown strategy %q", c.GetNodesStrategy))
+	}
+
+	hasMinerSettings := c.MinerSettings != (MinerNetSettings{})
+	if hasMinerSettings {
+		problems = c.MinerSettings.validate("miner-settings", problems)
+	}
+	if !hasMinerSettings && len(c.Networks) == 0 {
+		problems = append(problems, "networks: no miner-settings or networks defined")
+	}
+
+	ids := make([]string, 0, len(c.Networks))
+	for id := range c.Networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if id == "" {
+			problems = append(problems, "networks: network IDs cannot be empty")
+			continue
+		}
+		if id == defaultNetwork && hasMinerSettings {
+			problems = append(problems, "networks."+id+": already defined by miner-settings")
+		}
+		problems = c.Networks[id].validate("networks."+id, problems)
+	}
+	return problems
+}
+
+// Drops the problems with fields already reported missing, which would
+// only repeat them as e.g. "must be at least 1".
+func withoutMissing(problems, missing []string) []string {
+	var kept []string
+	for _, p := range problems {
+		repeat := false
+		for _, m := range missing {
+			field := strings.TrimSuffix(m, ": is required")
+			if strings.HasPrefix(p, field+":") || strings.HasPrefix(p, field+".") {
+				repeat = true
+				break
+			}
+		}
+		if !repeat {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Checks that addr is ip:port (or :port) with a usable port.
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("bad port %q", port)
+	}
+	return nil
+}
+
+// Prints a config with every default filled in, and a freshly generated
+// genesis block hash for its network.
+func printDefaultConfig() {
+	c := defaultConfig()
+	c.MinerSettings = defaultMinerNetSettings
+	c.Networks = make(map[string]MinerNetSettings)
+	genesis := make([]byte, hashHexLen/2)
+	_, err := rand.Read(genesis)
+	handleErrorFatal("genesis block hash", err)
+	c.MinerSettings.GenesisBlockHash = hex.EncodeToString(genesis)
+
+	out, err := json.MarshalIndent(c, "", "    ")
+	handleErrorFatal("print config", err)
+	fmt.Println(string(out))
 }
 
 type Config struct {
 	MinerSettings    MinerNetSettings `json:"miner-settings"`
 	RpcIpPort        string           `json:"rpc-ip-port"`
 	NumMinerToReturn uint8            `json:"num-miner-to-return"`
+
+	// Canvases hosted by this server, by network ID.
+	Networks map[string]MinerNetSettings `json:"networks"`
+
+	// Peer selection strategy for GetNodes (see peerSelectors).
+	GetNodesStrategy string `json:"get-nodes-strategy"`
+
+	// Most connections the server lets a miner have in its graph model;
+	// 0 means no bound.
+	MaxDegree uint8 `json:"max-degree"`
+
+	// File to persist registered miners to; empty keeps them in memory only.
+	RegistryPath string `json:"registry-path"`
+
+	// Milliseconds a restored miner has to send its first heartbeat.
+	RegistryGrace uint32 `json:"registry-grace"`
+
+	// ip:port for the JSON status endpoints; empty disables them.
+	AdminHttpAddr string `json:"admin-http-addr"`
+
+	// Bearer token required by POST /reload; empty disables /reload.
+	AdminToken string `json:"admin-token"`
 }
 
 type AllMiners struct {
 	sync.RWMutex
-	all map[string]*Miner
+	all   map[string]*Miner
+	dirty int32 // set (atomically) when registrations changed since the registry was last saved
+	beats int32 // set (atomically) when only heartbeat times changed
+}
+
+func (a *AllMiners) markDirty() {
+	atomic.StoreInt32(&a.dirty, 1)
 }
 
+func (a *AllMiners) markBeat() {
+	atomic.StoreInt32(&a.beats, 1)
+}
+
+// A registered miner as saved in the registry file.
+type registryRecord struct {
+	Key             string `json:"key"` // hex of pubKeyToString
+	NetworkID       string `json:"network-id"`
+	Network         string `json:"network"`
+	Address         string `json:"address"`
+	RecentHeartbeat int64  `json:"recent-heartbeat"`
+}
+
+// How often heartbeat times are written to the registry when no
+// registration changed. Restored miners get "registry-grace" anyway, so the
+// saved times only need to be roughly right.
+const heartbeatFlushInterval = time.Minute
+
 var (
 	unknownKeyError UnknownKeyError = errors.New("BlockArt server: unknown key")
 	config          Config
 	errLog          *log.Logger = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 	outLog          *log.Logger = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
+	// Guards config, which reloadConfig replaces wholesale.
+	configLock sync.RWMutex
 	// Miners in the system.
 	allMiners AllMiners = AllMiners{all: make(map[string]*Miner)}
+	// Registration nonces that have been handed out.
+	nonces Nonces = Nonces{all: make(map[string]int64)}
+	// Times out miners whose heartbeats have lapsed.
+	expiry ExpiryScheduler = ExpiryScheduler{wake: make(chan struct{}, 1)}
+	// Who is connected to whom, as far as the server knows.
+	networkGraph NetworkGraph = NetworkGraph{edges: make(map[string]map[string]bool)}
 )
 
 func readConfigOrDie(path string) {
-	file, err := os.Open(path)
-	handleErrorFatal("config file", err)
+	c, err := loadConfig(path)
+	handleErrorFatal("config", err)
+	config = c
+}
 
-	buffer, err := ioutil.ReadAll(file)
-	handleErrorFatal("read config", err)
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(buffer, &c); err != nil {
+		return c, fmt.Errorf("parse %s: %s", path, err)
+	}
+	missing := missingConfigFields(buffer)
+	if problems := append(missing, withoutMissing(c.validate(), missing)...); len(problems) > 0 {
+		return c, InvalidConfigError(problems)
+	}
 
-	err = json.Unmarshal(buffer, &config)
-	handleErrorFatal("parse config", err)
+	networks := make(map[string]MinerNetSettings, len(c.Networks)+1)
+	for id, settings := range c.Networks {
+		networks[id] = settings
+	}
+	if c.MinerSettings != (MinerNetSettings{}) {
+		networks[defaultNetwork] = c.MinerSettings
+	}
+	c.Networks = networks
+	return c, nil
+}
+
+// Returns a snapshot of the running config. Its Networks map is never
+// modified, only replaced by reloadConfig.
+func currentConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+// Re-reads the config file and switches to it if it only changes fields
+// that are safe to change at runtime (see checkReload).
+func reloadConfig(path string) error {
+	newConfig, err := loadConfig(path)
+	if _, ok := err.(InvalidConfigError); ok {
+		return err
+	} else if err != nil {
+		return ConfigReloadError(err.Error())
+	}
+
+	configLock.Lock()
+	if problems := checkReload(config, newConfig); len(problems) > 0 {
+		configLock.Unlock()
+		return ConfigReloadError(strings.Join(problems, "; "))
+	}
+	config = newConfig
+	configLock.Unlock()
+
+	// allMiners is taken before configLock everywhere else.
+	applyHeartBeats()
+
+	outLog.Printf("Reloaded config from %s\n", path)
+	return nil
+}
+
+// Gives every registered miner the heartbeat interval of its network in
+// the running config, and moves its expiry check to match.
+func applyHeartBeats() {
+	allMiners.Lock()
+	defer allMiners.Unlock()
+	for _, miner := range allMiners.all {
+		miner.HeartBeat = heartBeatInterval(miner.NetworkID)
+	}
+	expiry.reschedule()
+}
+
+// Lists the changes from old to new that cannot be applied while the
+// server is running.
+func checkReload(old, new Config) []string {
+	var problems []string
+	needsRestart := func(field, was, is string) {
+		if was != is {
+			problems = append(problems, field+" needs a restart to change")
+		}
+	}
+	needsRestart("rpc-ip-port", old.RpcIpPort, new.RpcIpPort)
+	needsRestart("admin-http-addr", old.AdminHttpAddr, new.AdminHttpAddr)
+	needsRestart("registry-path", old.RegistryPath, new.RegistryPath)
+
+	ids := make([]string, 0, len(old.Networks))
+	for id := range old.Networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		was := old.Networks[id]
+		is, ok := new.Networks[id]
+		if !ok {
+			problems = append(problems, "networks."+id+" cannot be removed while running")
+			continue
+		}
+		// Miners mining this network agree on these; changing them
+		// would fork the chain.
+		consensus := func(field string, changed bool) {
+			if changed {
+				problems = append(problems, "networks."+id+"."+field+" cannot change without forking the network")
+			}
+		}
+		consensus("genesis-block-hash", was.GenesisBlockHash != is.GenesisBlockHash)
+		consensus("ink-per-op-block", was.InkPerOpBlock != is.InkPerOpBlock)
+		consensus("ink-per-no-op-block", was.InkPerNoOpBlock != is.InkPerNoOpBlock)
+		consensus("pow-difficulty-op-block", was.PoWDifficultyOpBlock != is.PoWDifficultyOpBlock)
+		consensus("pow-difficulty-no-op-block", was.PoWDifficultyNoOpBlock != is.PoWDifficultyNoOpBlock)
+		consensus("canvas-settings", was.CanvasSettings != is.CanvasSettings)
+		if was.MinNumMinerConnections != is.MinNumMinerConnections {
+			problems = append(problems, "networks."+id+".min-num-miner-connections cannot change while running")
+		}
+	}
+	return problems
+}
+
+// Reloads the config whenever the server gets a SIGHUP.
+func reloadOnSignal(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(path); err != nil {
+			errLog.Println(err)
+		}
+	}
+}
+
+// Returns the settings of the network with the given ID ("" for the
+// default network).
+func networkSettings(networkID string) (MinerNetSettings, bool) {
+	settings, ok := currentConfig().Networks[normalizeNetworkID(networkID)]
+	return settings, ok
+}
+
+func normalizeNetworkID(networkID string) string {
+	if networkID == "" {
+		return defaultNetwork
+	}
+	return networkID
+}
+
+func heartBeatInterval(networkID string) time.Duration {
+	settings, _ := networkSettings(networkID)
+	return time.Duration(settings.HeartBeat) * time.Millisecond
 }
 
 // Parses args, setups up RPC server.
@@ -146,8 +696,13 @@ func main() {
 	gob.Register(&elliptic.CurveParams{})
 
 	path := flag.String("c", "", "Path to the JSON config")
+	printDefault := flag.Bool("print-default-config", false, "Print a config with the default settings (and a fresh genesis block hash) and exit")
 	flag.Parse()
 
+	if *printDefault {
+		printDefaultConfig()
+		return
+	}
 	if *path == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -155,18 +710,32 @@ func main() {
 
 	readConfigOrDie(*path)
 
-	rand.Seed(time.Now().UnixNano())
+	mathrand.Seed(time.Now().UnixNano())
+
+	if config.RegistryPath != "" {
+		restoreRegistryOrDie(config.RegistryPath)
+		go persistRegistry(config.RegistryPath)
+		go saveRegistryOnExit(config.RegistryPath)
+	}
+
+	go expiry.run()
 
 	rserver := new(RServer)
 
 	server := rpc.NewServer()
 	server.Register(rserver)
 
+	if config.AdminHttpAddr != "" {
+		go serveAdminHttp(config.AdminHttpAddr, *path)
+	}
+
 	l, e := net.Listen("tcp", config.RpcIpPort)
 
 	handleErrorFatal("listen error", e)
 	outLog.Printf("Server started. Receiving on %s\n", config.RpcIpPort)
 
+	go reloadOnSignal(*path)
+
 	for {
 		conn, _ := l.Accept()
 		go server.ServeConn(conn)
@@ -178,22 +747,261 @@ type MinerInfo struct {
 	Key     ecdsa.PublicKey
 }
 
-// Function to delete dead miners (no recent heartbeat)
-func monitor(k string, heartBeatInterval time.Duration) {
+// An ecdsa signature made with a miner's private key.
+type Signature struct {
+	R, S *big.Int
+}
+
+type RegisterArgs struct {
+	MinerInfo MinerInfo
+	NetworkID string    // network to join; "" for the default network
+	Nonce     string    // from GetRegistrationNonce
+	Sig       Signature // over registerDigest(MinerInfo, NetworkID, Nonce)
+}
+
+type GetNodesArgs struct {
+	Signed    SignedKey // purpose "getnodes"
+	NetworkID string    // network the miner registered with; "" for the default network
+}
+
+// A public key with a signed timestamp proving the caller holds the
+// matching private key.
+type SignedKey struct {
+	Key       ecdsa.PublicKey
+	Timestamp int64     // unix nanoseconds
+	Sig       Signature // over timestampDigest(purpose, Key, Timestamp)
+}
+
+// How long a registration nonce stays valid.
+const nonceLifetime = time.Minute
+
+// Most registration nonces handed out within nonceLifetime. Anyone may
+// ask for a nonce, so this bounds what callers can make the server hold.
+const maxNonces = 4096
+
+// How far a signed timestamp may be from the server's clock.
+const maxClockSkew = time.Minute
+
+// Registration nonces handed out and not used yet, with their expiry.
+// Every nonce lives for nonceLifetime, so order, the nonces in the order
+// they were handed out, is also the order they expire in.
+type Nonces struct {
+	sync.Mutex
+	all   map[string]int64
+	order []nonceEntry
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires int64 // unix nanoseconds
+}
+
+// Forgets the nonces that have expired by now. Must be called with n held.
+func (n *Nonces) sweep(now int64) {
+	i := 0
+	for i < len(n.order) && n.order[i].expires < now {
+		delete(n.all, n.order[i].nonce)
+		i++
+	}
+	n.order = n.order[i:]
+}
+
+func registerDigest(m MinerInfo, networkID string, nonce string) []byte {
+	sum := sha256.Sum256([]byte("register:" + nonce + ":" + networkID + ":" + m.Address.Network() + ":" + m.Address.String() + ":" + pubKeyToString(m.Key)))
+	return sum[:]
+}
+
+// purpose keeps a signature for one call from being used for another.
+func timestampDigest(purpose string, key ecdsa.PublicKey, timestamp int64) []byte {
+	sum := sha256.Sum256([]byte(purpose + ":" + strconv.FormatInt(timestamp, 10) + ":" + pubKeyToString(key)))
+	return sum[:]
+}
+
+func verify(key ecdsa.PublicKey, digest []byte, sig Signature) bool {
+	if key.Curve == nil || key.X == nil || key.Y == nil || sig.R == nil || sig.S == nil {
+		return false
+	}
+	return ecdsa.Verify(&key, digest, sig.R, sig.S)
+}
+
+// Checks the signature and freshness of a SignedKey. Replays are caught by
+// the callers, which know the miner's last timestamp.
+func verifySignedKey(purpose string, sk SignedKey) error {
+	if !verify(sk.Key, timestampDigest(purpose, sk.Key, sk.Timestamp), sk.Sig) {
+		return InvalidSignatureError(purpose)
+	}
+	skew := time.Duration(time.Now().UnixNano() - sk.Timestamp)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return StaleRequestError(strconv.FormatInt(sk.Timestamp, 10))
+	}
+	return nil
+}
+
+// Hands out a random single-use nonce for the caller to sign and pass to
+// Register. Nonces expire after a minute.
+// Can return the following errors:
+// - TooManyNoncesError if maxNonces were handed out within the last minute.
+func (s *RServer) GetRegistrationNonce(_ignored bool, nonce *string) error {
+	nonces.Lock()
+	defer nonces.Unlock()
+	now := time.Now().UnixNano()
+	nonces.sweep(now)
+	if len(nonces.order) >= maxNonces {
+		return TooManyNoncesError(len(nonces.order))
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	n := hex.EncodeToString(buf)
+	nonces.all[n] = now + int64(nonceLifetime)
+	nonces.order = append(nonces.order, nonceEntry{n, now + int64(nonceLifetime)})
+
+	*nonce = n
+	return nil
+}
+
+// Records timestamp in last, one of a Miner's last signed timestamps;
+// returns false if it is not newer than the one there.
+func advanceTimestamp(last *int64, timestamp int64) bool {
+	old := atomic.LoadInt64(last)
+	return timestamp > old && atomic.CompareAndSwapInt64(last, old, timestamp)
+}
+
+// Uses up a nonce; returns false if it was never issued or has expired.
+func takeNonce(n string) bool {
+	nonces.Lock()
+	defer nonces.Unlock()
+	expires, ok := nonces.all[n]
+	delete(nonces.all, n)
+	return ok && expires >= time.Now().UnixNano()
+}
+
+// One registration waiting to be checked for a lapsed heartbeat.
+type expiryEntry struct {
+	key      string
+	miner    *Miner
+	deadline int64 // unix nanoseconds
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].deadline < h[j].deadline }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// Deletes dead miners (no recent heartbeat). A single goroutine sleeps
+// until the earliest deadline in a heap of registrations, so heartbeats
+// only have to store a timestamp. When a deadline comes up the miner's
+// latest heartbeat is checked and the entry is pushed back if it has
+// been renewed. Entries for registrations that are gone (unregistered, or
+// replaced by a newer registration for the same key) are dropped.
+type ExpiryScheduler struct {
+	sync.Mutex
+	entries expiryHeap
+	wake    chan struct{}
+}
+
+// Schedules a check of miner's heartbeat at deadline.
+func (e *ExpiryScheduler) add(k string, miner *Miner, deadline int64) {
+	e.Lock()
+	heap.Push(&e.entries, expiryEntry{k, miner, deadline})
+	first := e.entries[0].miner == miner
+	e.Unlock()
+
+	if first {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Recomputes every deadline from the miner's latest heartbeat and its
+// current interval. Must be called with allMiners held.
+func (e *ExpiryScheduler) reschedule() {
+	e.Lock()
+	for i := range e.entries {
+		miner := e.entries[i].miner
+		e.entries[i].deadline = atomic.LoadInt64(&miner.RecentHeartbeat) + int64(miner.HeartBeat) + 1
+	}
+	heap.Init(&e.entries)
+	e.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *ExpiryScheduler) run() {
+	timer := time.NewTimer(time.Hour)
 	for {
-		allMiners.Lock()
-		if time.Now().UnixNano()-allMiners.all[k].RecentHeartbeat > int64(heartBeatInterval) {
-			outLog.Printf("%s timed out\n", allMiners.all[k].Address.String())
-			delete(allMiners.all, k)
-			allMiners.Unlock()
-			return
+		e.Lock()
+		wait := time.Hour
+		if len(e.entries) > 0 {
+			wait = time.Duration(e.entries[0].deadline - time.Now().UnixNano())
 		}
-		outLog.Printf("%s is alive\n", allMiners.all[k].Address.String())
-		allMiners.Unlock()
-		time.Sleep(heartBeatInterval)
+		e.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-e.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		e.expire()
 	}
 }
 
+// Handles every entry whose deadline has passed.
+func (e *ExpiryScheduler) expire() {
+	now := time.Now().UnixNano()
+
+	e.Lock()
+	var due []expiryEntry
+	for len(e.entries) > 0 && e.entries[0].deadline <= now {
+		due = append(due, heap.Pop(&e.entries).(expiryEntry))
+	}
+	e.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	allMiners.Lock()
+	for _, entry := range due {
+		if allMiners.all[entry.key] != entry.miner {
+			continue
+		}
+		recent := atomic.LoadInt64(&entry.miner.RecentHeartbeat)
+		heartBeatInterval := int64(entry.miner.HeartBeat)
+		if now-recent > heartBeatInterval {
+			outLog.Printf("%s timed out\n", entry.miner.Address.String())
+			delete(allMiners.all, entry.key)
+			allMiners.markDirty()
+			networkGraph.Lock()
+			networkGraph.removeNode(entry.key)
+			networkGraph.Unlock()
+			continue
+		}
+		entry.deadline = recent + heartBeatInterval + 1
+		e.Lock()
+		heap.Push(&e.entries, entry)
+		e.Unlock()
+	}
+	allMiners.Unlock()
+}
+
 func pubKeyToString(key ecdsa.PublicKey) string {
 	return string(elliptic.Marshal(key.Curve, key.X, key.Y))
 }
@@ -201,12 +1009,33 @@ func pubKeyToString(key ecdsa.PublicKey) string {
 // Registers a new miner with an address for other miner to use to
 // connect to it (returned in GetNodes call below), and a
 // public-key for this miner. Returns error, or if error is not set,
-// then setting for this canvas instance.
+// then setting for this canvas instance. The miner joins the network
+// named by NetworkID, and must sign a nonce from GetRegistrationNonce (see
+// registerDigest) with the private key for m.Key.
 //
 // Returns:
+// - UnknownNetworkError if the server does not host the requested network.
 // - AddressAlreadyRegisteredError if the server has already registered this address.
 // - KeyAlreadyRegisteredError if the server already has a registration record for publicKey.
-func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
+// - StaleRequestError if the nonce is unknown, used or expired.
+// - InvalidSignatureError if the nonce was not signed with the key's private key.
+func (s *RServer) Register(args RegisterArgs, r *MinerNetSettings) error {
+	m := args.MinerInfo
+	if m.Address == nil {
+		return InvalidSignatureError("missing address")
+	}
+	networkID := normalizeNetworkID(args.NetworkID)
+	settings, ok := networkSettings(networkID)
+	if !ok {
+		return UnknownNetworkError(args.NetworkID)
+	}
+	if !takeNonce(args.Nonce) {
+		return StaleRequestError(args.Nonce)
+	}
+	if !verify(m.Key, registerDigest(m, args.NetworkID, args.Nonce), args.Sig) {
+		return InvalidSignatureError(m.Address.String())
+	}
+
 	allMiners.Lock()
 	defer allMiners.Unlock()
 
@@ -221,31 +1050,37 @@ func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
 		}
 	}
 
-	allMiners.all[k] = &Miner{
-		m.Address,
-		time.Now().UnixNano(),
+	miner := &Miner{
+		Address:         m.Address,
+		NetworkID:       networkID,
+		RecentHeartbeat: time.Now().UnixNano(),
+		HeartBeat:       time.Duration(settings.HeartBeat) * time.Millisecond,
 	}
+	allMiners.all[k] = miner
+	allMiners.markDirty()
 
-	go monitor(k, time.Duration(config.MinerSettings.HeartBeat)*time.Millisecond)
+	expiry.add(k, miner, miner.RecentHeartbeat+int64(miner.HeartBeat)+1)
 
-	*r = config.MinerSettings
+	*r = settings
 
-	outLog.Printf("Got Register from %s\n", m.Address.String())
+	outLog.Printf("Got Register from %s for network %s\n", m.Address.String(), networkID)
 
 	return nil
 }
 
-type Addresses []net.Addr
-
-func (a Addresses) Len() int           { return len(a) }
-func (a Addresses) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a Addresses) Less(i, j int) bool { return a[i].String() < a[j].String() }
-
-// Returns addresses for a subset of miners in the system.
+// Returns addresses for a subset of the miners in the caller's network.
+// The caller signs a timestamp (purpose "getnodes") newer than that of its
+// previous GetNodes call.
 //
 // Returns:
-// - UnknownKeyError if the server does not know a miner with this publicKey.
-func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
+// - UnknownKeyError if this publicKey is not registered in the given network.
+// - InvalidSignatureError if the timestamp was not signed with the key's private key.
+// - StaleRequestError if the timestamp is too far off or not newer than the last one.
+func (s *RServer) GetNodes(args GetNodesArgs, addrSet *[]net.Addr) error {
+	if err := verifySignedKey("getnodes", args.Signed); err != nil {
+		return err
+	}
+	key := args.Signed.Key
 
 	// TODO: validate miner's GetNodes protocol? (could monitor state
 	// of network graph/connectivity and validate protocol FSM)
@@ -255,33 +1090,37 @@ func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
 
 	k := pubKeyToString(key)
 
-	if _, ok := allMiners.all[k]; !ok {
+	self, ok := allMiners.all[k]
+	if !ok || self.NetworkID != normalizeNetworkID(args.NetworkID) {
 		return unknownKeyError
 	}
+	if !advanceTimestamp(&self.LastNodesTimestamp, args.Signed.Timestamp) {
+		return StaleRequestError(strconv.FormatInt(args.Signed.Timestamp, 10))
+	}
 
-	minerAddresses := make([]net.Addr, 0, len(allMiners.all)-1)
-
+	candidates := make([]string, 0, len(allMiners.all)-1)
 	for pubKey, miner := range allMiners.all {
-		if pubKey == k {
+		if pubKey == k || miner.NetworkID != self.NetworkID {
 			continue
 		}
-		minerAddresses = append(minerAddresses, miner.Address)
+		candidates = append(candidates, pubKey)
 	}
+	sort.Strings(candidates)
 
-	sort.Sort(Addresses(minerAddresses))
+	networkGraph.Lock()
+	defer networkGraph.Unlock()
 
-	deterministicRandomNumber := key.X.Int64() % 32
-	r := rand.New(rand.NewSource(deterministicRandomNumber))
-	for n := len(minerAddresses); n > 0; n-- {
-		randIndex := r.Intn(n)
-		minerAddresses[n-1], minerAddresses[randIndex] = minerAddresses[randIndex], minerAddresses[n-1]
-	}
+	c := currentConfig()
+	selected := peerSelectors[c.GetNodesStrategy].SelectPeers(k, key, candidates, &networkGraph, int(c.NumMinerToReturn))
 
-	n := len(minerAddresses)
-	if int(config.NumMinerToReturn) < n {
-		n = int(config.NumMinerToReturn)
+	minerAddresses := make([]net.Addr, 0, len(selected))
+	for _, pubKey := range selected {
+		minerAddresses = append(minerAddresses, allMiners.all[pubKey].Address)
+		// Assume the caller connects to what we hand out until it
+		// tells us otherwise.
+		networkGraph.addEdge(k, pubKey)
 	}
-	*addrSet = minerAddresses[:n]
+	*addrSet = minerAddresses
 
 	return nil
 }
@@ -292,22 +1131,621 @@ func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
 // the server will stop returning this miner's address/key to other
 // miners.
 //
+// Each heartbeat carries a timestamp signed with the miner's private key
+// (purpose "heartbeat"), newer than that of its previous heartbeat.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+// - InvalidSignatureError if the timestamp was not signed with the key's private key.
+// - StaleRequestError if the timestamp is too far off or not newer than the last one.
+func (s *RServer) HeartBeat(sk SignedKey, _ignored *bool) error {
+	if err := verifySignedKey("heartbeat", sk); err != nil {
+		return err
+	}
+
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+
+	k := pubKeyToString(sk.Key)
+	miner, ok := allMiners.all[k]
+	if !ok {
+		return unknownKeyError
+	}
+
+	last := atomic.LoadInt64(&miner.LastSignedTimestamp)
+	if sk.Timestamp <= last || !atomic.CompareAndSwapInt64(&miner.LastSignedTimestamp, last, sk.Timestamp) {
+		return StaleRequestError(strconv.FormatInt(sk.Timestamp, 10))
+	}
+
+	atomic.StoreInt64(&miner.RecentHeartbeat, time.Now().UnixNano())
+	allMiners.markBeat()
+
+	return nil
+}
+
+// Returns the heartbeat interval in milliseconds of the network with the
+// given ID ("" for the default network). It changes when the config is
+// reloaded with a new one, so miners ask for it as they heartbeat.
+//
+// Returns:
+// - UnknownNetworkError if there is no such network.
+func (s *RServer) HeartBeatInterval(networkID string, interval *uint32) error {
+	settings, ok := networkSettings(networkID)
+	if !ok {
+		return UnknownNetworkError(networkID)
+	}
+	*interval = settings.HeartBeat
+	return nil
+}
+
+// Removes a miner's registration right away, so that other miners stop
+// getting its address from GetNodes without waiting for its heartbeat to
+// lapse. Called by miners when they shut down, with a timestamp signed
+// for purpose "unregister".
+//
 // Returns:
 // - UnknownKeyError if the server does not know a miner with this publicKey.
-func (s *RServer) HeartBeat(key ecdsa.PublicKey, _ignored *bool) error {
+// - InvalidSignatureError if the timestamp was not signed with the key's private key.
+// - StaleRequestError if the timestamp is too far off or not newer than the last one.
+func (s *RServer) Unregister(sk SignedKey, _ignored *bool) error {
+	if err := verifySignedKey("unregister", sk); err != nil {
+		return err
+	}
+
 	allMiners.Lock()
 	defer allMiners.Unlock()
 
-	k := pubKeyToString(key)
-	if _, ok := allMiners.all[k]; !ok {
+	k := pubKeyToString(sk.Key)
+	miner, ok := allMiners.all[k]
+	if !ok {
 		return unknownKeyError
 	}
+	if sk.Timestamp <= atomic.LoadInt64(&miner.LastSignedTimestamp) {
+		return StaleRequestError(strconv.FormatInt(sk.Timestamp, 10))
+	}
+
+	delete(allMiners.all, k)
+	allMiners.markDirty()
+	networkGraph.Lock()
+	networkGraph.removeNode(k)
+	networkGraph.Unlock()
+	outLog.Printf("Got Unregister from %s\n", miner.Address.String())
+
+	return nil
+}
+
+// Loads the miners saved by a previous run. Each one gets the grace period
+// to send a heartbeat before it is timed out.
+func restoreRegistryOrDie(path string) {
+	buffer, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	handleErrorFatal("read registry", err)
+
+	var records []registryRecord
+	err = json.Unmarshal(buffer, &records)
+	handleErrorFatal("parse registry", err)
+
+	allMiners.Lock()
+	defer allMiners.Unlock()
+	for _, r := range records {
+		key, err := hex.DecodeString(r.Key)
+		if err != nil {
+			errLog.Printf("skipping registry entry for %s: %s\n", r.Address, err)
+			continue
+		}
+		addr, err := net.ResolveTCPAddr(r.Network, r.Address)
+		if err != nil {
+			errLog.Printf("skipping registry entry for %s: %s\n", r.Address, err)
+			continue
+		}
+		networkID := normalizeNetworkID(r.NetworkID)
+		if _, ok := networkSettings(networkID); !ok {
+			errLog.Printf("skipping registry entry for %s: network %s is gone\n", r.Address, networkID)
+			continue
+		}
+
+		heartBeatInterval := heartBeatInterval(networkID)
+		grace := time.Duration(config.RegistryGrace) * time.Millisecond
+		if grace == 0 {
+			grace = 3 * heartBeatInterval
+		}
+		// Miners are timed out heartBeatInterval after RecentHeartbeat.
+		earliest := time.Now().Add(grace - heartBeatInterval).UnixNano()
+
+		miner := &Miner{Address: addr, NetworkID: networkID, RecentHeartbeat: r.RecentHeartbeat, HeartBeat: heartBeatInterval}
+		if miner.RecentHeartbeat < earliest {
+			miner.RecentHeartbeat = earliest
+		}
+		allMiners.all[string(key)] = miner
+		expiry.add(string(key), miner, miner.RecentHeartbeat+int64(heartBeatInterval)+1)
+	}
+	outLog.Printf("Restored %d miners from %s\n", len(allMiners.all), path)
+}
+
+// Saves the registry as soon as registrations change. Heartbeat times only
+// change the file every heartbeatFlushInterval; with any live miner they
+// change every second.
+func persistRegistry(path string) {
+	lastSave := time.Now()
+	for {
+		time.Sleep(time.Second)
+
+		if !atomic.CompareAndSwapInt32(&allMiners.dirty, 1, 0) {
+			if atomic.LoadInt32(&allMiners.beats) == 0 || time.Since(lastSave) < heartbeatFlushInterval {
+				continue
+			}
+		}
+		atomic.StoreInt32(&allMiners.beats, 0)
+
+		if err := writeRegistry(path); err != nil {
+			errLog.Printf("save registry: %s\n", err)
+			allMiners.markDirty()
+			continue
+		}
+		lastSave = time.Now()
+	}
+}
+
+// Saves the registry, heartbeat times included, and exits when the server
+// gets a SIGINT or SIGTERM.
+func saveRegistryOnExit(path string) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	if err := writeRegistry(path); err != nil {
+		errLog.Printf("save registry: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Snapshots the registered miners and saves them to path.
+func writeRegistry(path string) error {
+	allMiners.RLock()
+	records := make([]registryRecord, 0, len(allMiners.all))
+	for k, miner := range allMiners.all {
+		records = append(records, registryRecord{
+			hex.EncodeToString([]byte(k)),
+			miner.NetworkID,
+			miner.Address.Network(),
+			miner.Address.String(),
+			atomic.LoadInt64(&miner.RecentHeartbeat),
+		})
+	}
+	allMiners.RUnlock()
+	return saveRegistry(path, records)
+}
+
+// Writes the records to a temporary file first, so that a crash while
+// saving leaves the previous registry intact.
+func saveRegistry(path string, records []registryRecord) error {
+	buffer, err := json.MarshalIndent(records, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buffer); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type NeighbourReport struct {
+	Signed      SignedKey // purpose "neighbours"
+	Neighbours  []string  // addresses of the miners the reporter is connected to
+	ChainTip    string    // hash of the last block in the reporter's chain
+	ChainLength int
+}
+
+// Miners call this along with their heartbeats to tell the server who they
+// are actually connected to and how far their chain has got. The reported
+// neighbours replace the reporter's edges in the server's network graph.
+// The reporter signs a timestamp (purpose "neighbours") newer than that of
+// its previous report.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+// - InvalidSignatureError if the timestamp was not signed with the key's private key.
+// - StaleRequestError if the timestamp is too far off or not newer than the last one.
+func (s *RServer) ReportNeighbours(report NeighbourReport, _ignored *bool) error {
+	if err := verifySignedKey("neighbours", report.Signed); err != nil {
+		return err
+	}
+
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	k := pubKeyToString(report.Signed.Key)
+	miner, ok := allMiners.all[k]
+	if !ok {
+		return unknownKeyError
+	}
+	if !advanceTimestamp(&miner.LastReportTimestamp, report.Signed.Timestamp) {
+		return StaleRequestError(strconv.FormatInt(report.Signed.Timestamp, 10))
+	}
+
+	miner.Neighbours = report.Neighbours
+	miner.ChainTip = report.ChainTip
+	miner.ChainLength = report.ChainLength
+	miner.LastReport = time.Now().UnixNano()
+
+	keyByAddress := make(map[string]string, len(allMiners.all))
+	for pubKey, other := range allMiners.all {
+		keyByAddress[other.Address.String()] = pubKey
+	}
+
+	networkGraph.Lock()
+	defer networkGraph.Unlock()
+	networkGraph.removeNode(k)
+	for _, addr := range report.Neighbours {
+		// Neighbours that have not registered (or have timed out) are
+		// left out of the graph.
+		if other, ok := keyByAddress[addr]; ok && other != k {
+			networkGraph.addEdge(k, other)
+		}
+	}
+
+	return nil
+}
 
-	allMiners.all[k].RecentHeartbeat = time.Now().UnixNano()
+// One miner in the reply of GetNetworkGraph.
+type MinerStatus struct {
+	Address        string   `json:"address"`
+	NetworkID      string   `json:"network-id"`
+	Neighbours     []string `json:"neighbours"`  // reported by the miner
+	GraphEdges     []string `json:"graph-edges"` // addresses it is connected to in the server's graph
+	ChainTip       string   `json:"chain-tip"`
+	ChainLength    int      `json:"chain-length"`
+	HeartbeatAgeMs int64    `json:"heartbeat-age-ms"`
+	ReportAgeMs    int64    `json:"report-age-ms"` // -1 if the miner has never reported
+}
 
+// Returns the server's current view of the network: every registered
+// miner with its neighbours and chain tip. Meant for admin tools.
+func (s *RServer) GetNetworkGraph(_ignored bool, reply *[]MinerStatus) error {
+	*reply = networkStatus()
 	return nil
 }
 
+func networkStatus() []MinerStatus {
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+	networkGraph.RLock()
+	defer networkGraph.RUnlock()
+
+	now := time.Now().UnixNano()
+	status := make([]MinerStatus, 0, len(allMiners.all))
+	for k, miner := range allMiners.all {
+		edges := make([]string, 0, networkGraph.degree(k))
+		for other := range networkGraph.edges[k] {
+			if otherMiner, ok := allMiners.all[other]; ok {
+				edges = append(edges, otherMiner.Address.String())
+			}
+		}
+		sort.Strings(edges)
+
+		reportAge := int64(-1)
+		if miner.LastReport != 0 {
+			reportAge = (now - miner.LastReport) / int64(time.Millisecond)
+		}
+		status = append(status, MinerStatus{
+			Address:        miner.Address.String(),
+			NetworkID:      miner.NetworkID,
+			Neighbours:     miner.Neighbours,
+			GraphEdges:     edges,
+			ChainTip:       miner.ChainTip,
+			ChainLength:    miner.ChainLength,
+			HeartbeatAgeMs: (now - atomic.LoadInt64(&miner.RecentHeartbeat)) / int64(time.Millisecond),
+			ReportAgeMs:    reportAge,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Address < status[j].Address })
+	return status
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ADMIN HTTP>
+
+// The server's network graph as served on /topology.
+type Topology struct {
+	Miners     []string    `json:"miners"`
+	Edges      [][2]string `json:"edges"`
+	Components [][]string  `json:"components"` // more than one means the network is partitioned
+}
+
+func serveAdminHttp(addr string, configPath string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/miners", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, networkStatus())
+	})
+	mux.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, currentConfig().Networks)
+	})
+	mux.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, topology())
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		token := currentConfig().AdminToken
+		if token == "" {
+			http.Error(w, "reload is disabled: admin-token is not set", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "bad admin token", http.StatusUnauthorized)
+			return
+		}
+		if err := reloadConfig(configPath); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJson(w, currentConfig().Networks)
+	})
+
+	outLog.Printf("Admin HTTP started. Receiving on %s\n", addr)
+	errLog.Printf("admin http: %s\n", http.ListenAndServe(addr, mux))
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(v); err != nil {
+		errLog.Printf("admin http: %s\n", err)
+	}
+}
+
+func topology() Topology {
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+	networkGraph.RLock()
+	defer networkGraph.RUnlock()
+
+	t := Topology{Miners: []string{}, Edges: [][2]string{}, Components: [][]string{}}
+	keys := make([]string, 0, len(allMiners.all))
+	for k, miner := range allMiners.all {
+		keys = append(keys, k)
+		t.Miners = append(t.Miners, miner.Address.String())
+	}
+	sort.Strings(t.Miners)
+
+	for _, k := range keys {
+		for other := range networkGraph.edges[k] {
+			otherMiner, ok := allMiners.all[other]
+			if !ok || k > other {
+				continue
+			}
+			edge := [2]string{allMiners.all[k].Address.String(), otherMiner.Address.String()}
+			if edge[0] > edge[1] {
+				edge[0], edge[1] = edge[1], edge[0]
+			}
+			t.Edges = append(t.Edges, edge)
+		}
+	}
+	sort.Slice(t.Edges, func(i, j int) bool {
+		if t.Edges[i][0] != t.Edges[j][0] {
+			return t.Edges[i][0] < t.Edges[j][0]
+		}
+		return t.Edges[i][1] < t.Edges[j][1]
+	})
+
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		var component []string
+		for member := range networkGraph.component(k) {
+			seen[member] = true
+			if miner, ok := allMiners.all[member]; ok {
+				component = append(component, miner.Address.String())
+			}
+		}
+		sort.Strings(component)
+		t.Components = append(t.Components, component)
+	}
+	sort.Slice(t.Components, func(i, j int) bool { return t.Components[i][0] < t.Components[j][0] })
+
+	return t
+}
+
+// </ADMIN HTTP>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PEER SELECTION>
+
+// Undirected graph of miner connections, keyed by pubKeyToString.
+type NetworkGraph struct {
+	sync.RWMutex
+	edges map[string]map[string]bool
+}
+
+// Callers hold the graph's lock for all of the methods below.
+
+func (g *NetworkGraph) addEdge(a, b string) {
+	if g.edges[a] == nil {
+		g.edges[a] = make(map[string]bool)
+	}
+	if g.edges[b] == nil {
+		g.edges[b] = make(map[string]bool)
+	}
+	g.edges[a][b] = true
+	g.edges[b][a] = true
+}
+
+func (g *NetworkGraph) removeNode(k string) {
+	for other := range g.edges[k] {
+		delete(g.edges[other], k)
+	}
+	delete(g.edges, k)
+}
+
+func (g *NetworkGraph) degree(k string) int {
+	return len(g.edges[k])
+}
+
+// Returns the keys reachable from k, including k itself.
+func (g *NetworkGraph) component(k string) map[string]bool {
+	seen := map[string]bool{k: true}
+	queue := []string{k}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for other := range g.edges[next] {
+			if !seen[other] {
+				seen[other] = true
+				queue = append(queue, other)
+			}
+		}
+	}
+	return seen
+}
+
+// Chooses which miners GetNodes returns. candidates holds the keys of every
+// other registered miner, sorted; the selector returns at most n of them.
+// The graph is locked by the caller.
+type PeerSelector interface {
+	SelectPeers(k string, key ecdsa.PublicKey, candidates []string, graph *NetworkGraph, n int) []string
+}
+
+var peerSelectors = map[string]PeerSelector{
+	"":                 randomSelector{},
+	"random":           randomSelector{},
+	"random-regular":   randomRegularSelector{},
+	"ring-plus-chords": ringSelector{},
+	"least-connected":  leastConnectedSelector{},
+}
+
+// The original strategy: a shuffle seeded by the caller's key, ignoring the
+// graph.
+type randomSelector struct{}
+
+func (randomSelector) SelectPeers(k string, key ecdsa.PublicKey, candidates []string, graph *NetworkGraph, n int) []string {
+	// Called with allMiners read-locked by GetNodes.
+	sort.Slice(candidates, func(i, j int) bool {
+		return allMiners.all[candidates[i]].Address.String() < allMiners.all[candidates[j]].Address.String()
+	})
+
+	deterministicRandomNumber := key.X.Int64() % 32
+	r := mathrand.New(mathrand.NewSource(deterministicRandomNumber))
+	shuffle(r, candidates)
+	return firstN(candidates, n)
+}
+
+// Random miners, but only those with room for another connection, and
+// those in other components first.
+type randomRegularSelector struct{}
+
+func (randomRegularSelector) SelectPeers(k string, key ecdsa.PublicKey, candidates []string, graph *NetworkGraph, n int) []string {
+	candidates = eligible(k, candidates, graph)
+	shuffle(mathrand.New(mathrand.NewSource(time.Now().UnixNano())), candidates)
+	return firstN(preferOtherComponents(k, candidates, graph), n)
+}
+
+// Places every miner on a ring ordered by key and returns the caller's
+// successor and predecessor, then chords 2, 4, 8, ... places ahead. This
+// keeps the overlay connected with a diameter logarithmic in its size.
+type ringSelector struct{}
+
+func (ringSelector) SelectPeers(k string, key ecdsa.PublicKey, candidates []string, graph *NetworkGraph, n int) []string {
+	ring := append([]string{k}, candidates...)
+	sort.Strings(ring)
+	self := sort.SearchStrings(ring, k)
+
+	ok := make(map[string]bool)
+	for _, c := range eligible(k, candidates, graph) {
+		ok[c] = true
+	}
+
+	var picked []string
+	added := make(map[string]bool)
+	add := func(offset int) {
+		c := ring[((self+offset)%len(ring)+len(ring))%len(ring)]
+		if c != k && ok[c] && !added[c] && len(picked) < n {
+			added[c] = true
+			picked = append(picked, c)
+		}
+	}
+	add(1)
+	add(-1)
+	for offset := 2; offset < len(ring); offset *= 2 {
+		add(offset)
+	}
+	return picked
+}
+
+// The miners with the fewest connections, ties broken at random.
+type leastConnectedSelector struct{}
+
+func (leastConnectedSelector) SelectPeers(k string, key ecdsa.PublicKey, candidates []string, graph *NetworkGraph, n int) []string {
+	candidates = eligible(k, candidates, graph)
+	shuffle(mathrand.New(mathrand.NewSource(time.Now().UnixNano())), candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return graph.degree(candidates[i]) < graph.degree(candidates[j])
+	})
+	return firstN(preferOtherComponents(k, candidates, graph), n)
+}
+
+// Drops candidates that are already connected to k or have reached
+// config.MaxDegree.
+func eligible(k string, candidates []string, graph *NetworkGraph) []string {
+	maxDegree := int(currentConfig().MaxDegree)
+	result := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if graph.edges[k][c] {
+			continue
+		}
+		if maxDegree > 0 && graph.degree(c) >= maxDegree {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// Moves candidates outside k's component to the front, keeping the order
+// otherwise.
+func preferOtherComponents(k string, candidates []string, graph *NetworkGraph) []string {
+	component := graph.component(k)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return !component[candidates[i]] && component[candidates[j]]
+	})
+	return candidates
+}
+
+func shuffle(r *mathrand.Rand, keys []string) {
+	for n := len(keys); n > 0; n-- {
+		randIndex := r.Intn(n)
+		keys[n-1], keys[randIndex] = keys[randIndex], keys[n-1]
+	}
+}
+
+func firstN(keys []string, n int) []string {
+	if n < len(keys) {
+		return keys[:n]
+	}
+	return keys
+}
+
+// </PEER SELECTION>
+////////////////////////////////////////////////////////////////////////////////////////////
+
 func handleErrorFatal(msg string, e error) {
 	if e != nil {
 		errLog.Fatalf("%s, err = %s\n", msg, e.Error())
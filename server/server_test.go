@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A valid config with a single default network.
+func testConfig() Config {
+	c := defaultConfig()
+	c.Networks = map[string]MinerNetSettings{defaultNetwork: defaultMinerNetSettings}
+	settings := c.Networks[defaultNetwork]
+	settings.GenesisBlockHash = "00112233445566778899aabbccddeeff"
+	c.Networks[defaultNetwork] = settings
+	return c
+}
+
+// Installs c as the server's config; the returned func puts the old one back.
+func swapConfig(c Config) (restore func()) {
+	configLock.Lock()
+	old := config
+	config = c
+	configLock.Unlock()
+	return func() {
+		configLock.Lock()
+		config = old
+		configLock.Unlock()
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if problems := testConfig().validate(); len(problems) != 0 {
+		t.Error("Expected a valid config, got: ", problems)
+	}
+
+	c := testConfig()
+	c.NumMinerToReturn = 0
+	c.GetNodesStrategy = "nearest"
+	settings := c.Networks[defaultNetwork]
+	settings.GenesisBlockHash = "not hex"
+	settings.HeartBeat = 0
+	settings.PoWDifficultyOpBlock = 0
+	c.Networks[defaultNetwork] = settings
+
+	problems := strings.Join(c.validate(), "; ")
+	for _, want := range []string{"num-miner-to-return", "get-nodes-strategy", "genesis-block-hash: must be hex", "heartbeat: must be at least 1", "pow-difficulty-op-block: must be between 1 and 32"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("Expected a problem with %s, got: %s", want, problems)
+		}
+	}
+
+	if problems := (Config{RpcIpPort: "127.0.0.1:1", NumMinerToReturn: 1}).validate(); len(problems) != 1 || !strings.HasPrefix(problems[0], "networks:") {
+		t.Error("Expected a config without networks to be rejected, got: ", problems)
+	}
+}
+
+func TestLoadConfigReportsMissingFields(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"networks": {
+			"team": {
+				"genesis-block-hash": "00112233445566778899aabbccddeeff",
+				"min-num-miner-connections": 2,
+				"ink-per-op-block": 500,
+				"ink-per-no-op-block": 250,
+				"pow-difficulty-op-block": 3,
+				"pow-difficulty-no-op-block": 3,
+				"canvas-settings": {"canvas-x-max": 1024}
+			}
+		}
+	}`)
+	file.Close()
+
+	_, err = loadConfig(file.Name())
+	problems, ok := err.(InvalidConfigError)
+	want := "networks.team.heartbeat: is required; networks.team.canvas-settings.canvas-y-max: is required"
+	if !ok || strings.Join(problems, "; ") != want {
+		t.Errorf("Expected %q, got: %v", want, err)
+	}
+}
+
+func TestCheckReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		problem string // "" if the change may be reloaded
+	}{
+		{"num-miner-to-return", func(c *Config) { c.NumMinerToReturn = 9 }, ""},
+		{"get-nodes-strategy", func(c *Config) { c.GetNodesStrategy = "ring-plus-chords" }, ""},
+		{"new network", func(c *Config) { c.Networks["team"] = c.Networks[defaultNetwork] }, ""},
+		{"heartbeat", func(c *Config) { setNetwork(c, func(s *MinerNetSettings) { s.HeartBeat = 500 }) }, ""},
+		{"rpc-ip-port", func(c *Config) { c.RpcIpPort = "127.0.0.1:1" }, "rpc-ip-port needs a restart"},
+		{"removed network", func(c *Config) { delete(c.Networks, defaultNetwork) }, "cannot be removed"},
+		{"genesis", func(c *Config) { setNetwork(c, func(s *MinerNetSettings) { s.GenesisBlockHash = "ff" }) }, "genesis-block-hash cannot change"},
+		{"canvas", func(c *Config) { setNetwork(c, func(s *MinerNetSettings) { s.CanvasSettings.CanvasXMax++ }) }, "canvas-settings cannot change"},
+		{"min connections", func(c *Config) { setNetwork(c, func(s *MinerNetSettings) { s.MinNumMinerConnections++ }) }, "min-num-miner-connections cannot change"},
+	}
+	for _, test := range tests {
+		changed := testConfig()
+		test.change(&changed)
+		problems := checkReload(testConfig(), changed)
+		if test.problem == "" && len(problems) != 0 {
+			t.Errorf("%s: expected the change to reload, got: %v", test.name, problems)
+		}
+		if test.problem != "" && (len(problems) != 1 || !strings.Contains(problems[0], test.problem)) {
+			t.Errorf("%s: expected %q, got: %v", test.name, test.problem, problems)
+		}
+	}
+}
+
+func setNetwork(c *Config, change func(s *MinerNetSettings)) {
+	settings := c.Networks[defaultNetwork]
+	change(&settings)
+	c.Networks[defaultNetwork] = settings
+}
+
+func TestApplyHeartBeats(t *testing.T) {
+	c := testConfig()
+	setNetwork(&c, func(s *MinerNetSettings) { s.HeartBeat = 500 })
+	defer swapConfig(c)()
+
+	recent := time.Now().UnixNano()
+	miner := &Miner{Address: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, NetworkID: defaultNetwork, RecentHeartbeat: recent, HeartBeat: 10 * time.Second}
+	allMiners.Lock()
+	allMiners.all = map[string]*Miner{"a": miner}
+	allMiners.Unlock()
+	expiry.add("a", miner, recent+int64(10*time.Second)+1)
+	defer func() {
+		allMiners.Lock()
+		allMiners.all = make(map[string]*Miner)
+		allMiners.Unlock()
+		expiry.Lock()
+		expiry.entries = nil
+		expiry.Unlock()
+	}()
+
+	applyHeartBeats()
+
+	if miner.HeartBeat != 500*time.Millisecond {
+		t.Error("Expected the reloaded heartbeat, got: ", miner.HeartBeat)
+	}
+	expiry.Lock()
+	deadline := expiry.entries[0].deadline
+	expiry.Unlock()
+	if deadline != recent+int64(500*time.Millisecond)+1 {
+		t.Error("Expected the expiry to follow the reloaded heartbeat, got: ", time.Duration(deadline-recent))
+	}
+
+	var s RServer
+	var interval uint32
+	if err := s.HeartBeatInterval("", &interval); err != nil || interval != 500 {
+		t.Error("Expected a 500ms interval, got: ", interval, err)
+	}
+	if _, ok := s.HeartBeatInterval("nowhere", &interval).(UnknownNetworkError); !ok {
+		t.Error("Expected UnknownNetworkError for a missing network")
+	}
+}
+
+// A graph over keys "a" to "h" in which a-b and b-c are connected.
+func testGraph() (*NetworkGraph, []string) {
+	graph := &NetworkGraph{edges: make(map[string]map[string]bool)}
+	graph.addEdge("a", "b")
+	graph.addEdge("b", "c")
+	return graph, []string{"b", "c", "d", "e", "f", "g", "h"}
+}
+
+func TestRingSelector(t *testing.T) {
+	defer swapConfig(testConfig())()
+
+	graph, candidates := testGraph()
+	// a's successor b is already connected, so after its predecessor h
+	// come the chords 2 and 4 places ahead.
+	got := ringSelector{}.SelectPeers("a", ecdsa.PublicKey{}, candidates, graph, 3)
+	if strings.Join(got, ",") != "h,c,e" {
+		t.Error("Expected h,c,e, got: ", got)
+	}
+}
+
+func TestLeastConnectedSelector(t *testing.T) {
+	c := testConfig()
+	c.MaxDegree = 1
+	defer swapConfig(c)()
+
+	graph, candidates := testGraph()
+	graph.addEdge("d", "e")
+	// b is connected to a; c, d and e are at the max degree.
+	got := leastConnectedSelector{}.SelectPeers("a", ecdsa.PublicKey{}, candidates, graph, 5)
+	if len(got) != 3 {
+		t.Fatal("Expected f, g and h, got: ", got)
+	}
+	for _, k := range got {
+		if k != "f" && k != "g" && k != "h" {
+			t.Error("Expected only unconnected miners, got: ", got)
+		}
+	}
+}
+
+func TestRandomRegularSelectorPrefersOtherComponents(t *testing.T) {
+	defer swapConfig(testConfig())()
+
+	graph, _ := testGraph()
+	for i := 0; i < 10; i++ {
+		got := randomRegularSelector{}.SelectPeers("a", ecdsa.PublicKey{}, []string{"b", "c", "d"}, graph, 1)
+		if len(got) != 1 || got[0] != "d" {
+			t.Fatal("Expected d, outside a's component, got: ", got)
+		}
+	}
+}
+
+func TestRandomSelectorIsDeterministic(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allMiners.Lock()
+	allMiners.all = make(map[string]*Miner)
+	candidates := []string{"b", "c", "d", "e", "f"}
+	for i, k := range candidates {
+		allMiners.all[k] = &Miner{Address: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + i}}
+	}
+	allMiners.Unlock()
+	defer func() {
+		allMiners.Lock()
+		allMiners.all = make(map[string]*Miner)
+		allMiners.Unlock()
+	}()
+
+	graph, _ := testGraph()
+	first := randomSelector{}.SelectPeers("a", key.PublicKey, append([]string{}, candidates...), graph, 3)
+	second := randomSelector{}.SelectPeers("a", key.PublicKey, append([]string{}, candidates...), graph, 3)
+	if len(first) != 3 || strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Error("Expected the same 3 miners for the same key, got: ", first, second)
+	}
+}
+
+func TestRegistrationNonces(t *testing.T) {
+	nonces.Lock()
+	nonces.all, nonces.order = make(map[string]int64), nil
+	nonces.Unlock()
+
+	var s RServer
+	var n string
+	for i := 0; i < maxNonces; i++ {
+		if err := s.GetRegistrationNonce(false, &n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.GetRegistrationNonce(false, &n); err != TooManyNoncesError(maxNonces) {
+		t.Fatal("Expected TooManyNoncesError, got: ", err)
+	}
+	if !takeNonce(n) || takeNonce(n) {
+		t.Error("Expected a nonce to be taken exactly once")
+	}
+
+	nonces.Lock()
+	nonces.sweep(nonces.order[len(nonces.order)-1].expires + 1)
+	left := len(nonces.all) + len(nonces.order)
+	nonces.Unlock()
+	if left != 0 {
+		t.Error("Expected every nonce to have expired, got: ", left)
+	}
+	if err := s.GetRegistrationNonce(false, &n); err != nil {
+		t.Error("Expected a nonce once the old ones expired, got: ", err)
+	}
+}
+
+// Signs timestamp for purpose with key.
+func signedKey(t *testing.T, key *ecdsa.PrivateKey, purpose string, timestamp int64) SignedKey {
+	r, s, err := ecdsa.Sign(rand.Reader, key, timestampDigest(purpose, key.PublicKey, timestamp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SignedKey{key.PublicKey, timestamp, Signature{r, s}}
+}
+
+func TestSignedRequests(t *testing.T) {
+	defer swapConfig(testConfig())()
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allMiners.Lock()
+	allMiners.all = map[string]*Miner{
+		pubKeyToString(key.PublicKey): &Miner{Address: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, NetworkID: defaultNetwork},
+	}
+	allMiners.Unlock()
+	defer func() {
+		allMiners.Lock()
+		allMiners.all = make(map[string]*Miner)
+		allMiners.Unlock()
+		networkGraph.Lock()
+		networkGraph.edges = make(map[string]map[string]bool)
+		networkGraph.Unlock()
+	}()
+
+	var s RServer
+	var addrs []net.Addr
+	var ignored bool
+	now := time.Now().UnixNano()
+
+	getNodes := func(sk SignedKey) error { return s.GetNodes(GetNodesArgs{Signed: sk}, &addrs) }
+	report := func(sk SignedKey) error { return s.ReportNeighbours(NeighbourReport{Signed: sk}, &ignored) }
+	for name, call := range map[string]func(SignedKey) error{"getnodes": getNodes, "neighbours": report} {
+		if err := call(signedKey(t, key, name, now)); err != nil {
+			t.Fatalf("%s: expected a signed request to pass, got: %v", name, err)
+		}
+		if _, ok := call(signedKey(t, key, name, now)).(StaleRequestError); !ok {
+			t.Errorf("%s: expected a replayed timestamp to be stale", name)
+		}
+		if _, ok := call(signedKey(t, key, name, now-int64(2*maxClockSkew))).(StaleRequestError); !ok {
+			t.Errorf("%s: expected an old timestamp to be stale", name)
+		}
+		if _, ok := call(signedKey(t, key, "heartbeat", now+1)).(InvalidSignatureError); !ok {
+			t.Errorf("%s: expected a signature for another purpose to be rejected", name)
+		}
+		forged := signedKey(t, forger, name, now+1)
+		forged.Key = key.PublicKey
+		if _, ok := call(forged).(InvalidSignatureError); !ok {
+			t.Errorf("%s: expected a signature from another key to be rejected", name)
+		}
+		if err := call(signedKey(t, key, name, now+1)); err != nil {
+			t.Errorf("%s: expected a newer timestamp to pass, got: %v", name, err)
+		}
+	}
+}
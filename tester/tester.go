@@ -20,13 +20,16 @@ package main
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/sha256"
 	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
+	"math/big"
 	"net"
 	"net/rpc"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -35,6 +38,23 @@ type MinerInfo struct {
 	Key     ecdsa.PublicKey
 }
 
+type Signature struct {
+	R, S *big.Int
+}
+
+type RegisterArgs struct {
+	MinerInfo MinerInfo
+	NetworkID string
+	Nonce     string
+	Sig       Signature
+}
+
+type SignedKey struct {
+	Key       ecdsa.PublicKey
+	Timestamp int64
+	Sig       Signature
+}
+
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
@@ -79,6 +99,31 @@ func exitOnError(prefix string, err error) {
 
 var ExpectedError = errors.New("Expected error, none found")
 
+// Registers key at addr in the default network, signing the server's nonce with signer (which is
+// the private half of key unless testing a forged registration).
+func register(c *rpc.Client, addr net.Addr, key ecdsa.PublicKey, signer *ecdsa.PrivateKey, settings *MinerNetSettings) error {
+	var nonce string
+	if err := c.Call("RServer.GetRegistrationNonce", false, &nonce); err != nil {
+		return err
+	}
+	m := MinerInfo{Address: addr, Key: key}
+	sum := sha256.Sum256([]byte("register:" + nonce + "::" + addr.Network() + ":" + addr.String() + ":" + string(elliptic.Marshal(key.Curve, key.X, key.Y))))
+	r, s, err := ecdsa.Sign(randReader, signer, sum[:])
+	exitOnError("sign nonce", err)
+	return c.Call("RServer.Register", RegisterArgs{m, "", nonce, Signature{r, s}}, settings)
+}
+
+func sendHeartBeat(c *rpc.Client, priv *ecdsa.PrivateKey, timestamp int64) error {
+	key := priv.PublicKey
+	sum := sha256.Sum256([]byte("heartbeat:" + strconv.FormatInt(timestamp, 10) + ":" + string(elliptic.Marshal(key.Curve, key.X, key.Y))))
+	r, s, err := ecdsa.Sign(randReader, priv, sum[:])
+	exitOnError("sign heartbeat", err)
+	var _ignored bool
+	return c.Call("RServer.HeartBeat", SignedKey{key, timestamp, Signature{r, s}}, &_ignored)
+}
+
+var randReader *os.File
+
 func main() {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
@@ -98,6 +143,7 @@ func main() {
 	r, err := os.Open("/dev/urandom")
 	exitOnError("open /dev/urandom", err)
 	defer r.Close()
+	randReader = r
 
 	priv1, err := ecdsa.GenerateKey(elliptic.P384(), r)
 	exitOnError("generate key 1", err)
@@ -114,38 +160,55 @@ func main() {
 	defer c.Close()
 
 	var settings MinerNetSettings
-	var _ignored bool
 
 	// normal registration
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = register(c, addr1, priv1.PublicKey, priv1, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
-	err = c.Call("RServer.Register", MinerInfo{Address: addr2, Key: priv2.PublicKey}, &settings)
+	err = register(c, addr2, priv2.PublicKey, priv2, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr2.String()), err)
 	time.Sleep(twoHeartBeatIntervals)
 
 	// late heartbeat
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = register(c, addr1, priv1.PublicKey, priv1, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
 	time.Sleep(twoHeartBeatIntervals)
-	err = c.Call("RServer.HeartBeat", priv1.PublicKey, &_ignored)
+	err = sendHeartBeat(c, priv1, time.Now().UnixNano())
 	if err == nil {
 		exitOnError("late heartbeat", ExpectedError)
 	}
 
 	// register twice with same address
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = register(c, addr1, priv1.PublicKey, priv1, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv2.PublicKey}, &settings)
+	err = register(c, addr1, priv2.PublicKey, priv2, &settings)
 	if err == nil {
 		exitOnError("registering twice with the same address", ExpectedError)
 	}
 	time.Sleep(twoHeartBeatIntervals)
 
 	// register twice with same key
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = register(c, addr1, priv1.PublicKey, priv1, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
-	err = c.Call("RServer.Register", MinerInfo{Address: addr2, Key: priv1.PublicKey}, &settings)
+	err = register(c, addr2, priv1.PublicKey, priv1, &settings)
 	if err == nil {
 		exitOnError("registering twice with the same key", ExpectedError)
 	}
+	time.Sleep(twoHeartBeatIntervals)
+
+	// register someone else's key
+	err = register(c, addr1, priv1.PublicKey, priv2, &settings)
+	if err == nil {
+		exitOnError("registering a key without its private key", ExpectedError)
+	}
+
+	// replayed heartbeat
+	err = register(c, addr1, priv1.PublicKey, priv1, &settings)
+	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
+	timestamp := time.Now().UnixNano()
+	err = sendHeartBeat(c, priv1, timestamp)
+	exitOnError("heartbeat", err)
+	err = sendHeartBeat(c, priv1, timestamp)
+	if err == nil {
+		exitOnError("replayed heartbeat", ExpectedError)
+	}
 }